@@ -0,0 +1,98 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultBufferTypes are the upstream media types buffered for processing when none are configured
+var defaultBufferTypes = []string{"image/*"}
+
+// shouldBuffer decides from the upstream headers whether the response is buffered for processing.
+// Other responses are streamed to the client untouched.
+func (m *Middleware) shouldBuffer(status int, header http.Header) bool {
+	if status != http.StatusOK {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !matchMediaType(m.BufferTypes, mediaType) {
+		return false
+	}
+
+	if m.MaxBufferSize > 0 && header.Get("Content-Length") != "" {
+		size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err != nil || size > m.MaxBufferSize {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedRecorder enforces the buffer limit on responses buffered without Content-Length.
+// Once the limit is exceeded, the buffered part is sent and the rest is streamed untouched.
+type limitedRecorder struct {
+	caddyhttp.ResponseRecorder
+	w        http.ResponseWriter
+	limit    int64
+	streamed bool
+}
+
+func (lr *limitedRecorder) Write(data []byte) (int, error) {
+	if lr.streamed {
+		return lr.w.Write(data)
+	}
+
+	lr.ResponseRecorder.WriteHeader(http.StatusOK)
+	if !lr.Buffered() || lr.limit == 0 || int64(lr.Size()+len(data)) <= lr.limit {
+		return lr.ResponseRecorder.Write(data)
+	}
+
+	lr.streamed = true
+	lr.w.WriteHeader(lr.Status())
+	if _, err := lr.w.Write(lr.Buffer().Bytes()); err != nil {
+		return 0, err
+	}
+	lr.Buffer().Reset()
+	return lr.w.Write(data)
+}
+
+// FlushError flushes the response only once it is streamed
+func (lr *limitedRecorder) FlushError() error {
+	if lr.streamed {
+		return http.NewResponseController(lr.w).Flush()
+	}
+	return http.NewResponseController(lr.ResponseRecorder).Flush()
+}
+
+func (lr *limitedRecorder) Unwrap() http.ResponseWriter {
+	return lr.ResponseRecorder
+}
+
+// matchMediaType returns true if the media type matches one of the patterns, like image/png or image/*
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if pattern == mediaType {
+			return true
+		}
+		if prefix, found := strings.CutSuffix(pattern, "/*"); found && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMediaTypePatterns ensures patterns are media types like image/png or image/*
+func validateMediaTypePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		mainType, subType, found := strings.Cut(pattern, "/")
+		if !found || mainType == "" || subType == "" || mainType == "*" {
+			return fmt.Errorf("invalid media type '%s' in buffer_types (expected a type like image/png or image/*)", pattern)
+		}
+	}
+	return nil
+}
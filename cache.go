@@ -0,0 +1,368 @@
+package CADDY_FILE_SERVER
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+)
+
+const (
+	// defaultCachePrefix is the storage prefix used when none is configured.
+	defaultCachePrefix = "image_processor"
+
+	// defaultCacheMaxSize is the total size of cached variants used when none is configured (1GiB).
+	defaultCacheMaxSize = 1 << 30
+)
+
+// cacheIndexes holds the LRU indexes shared by handlers using the same storage and prefix.
+// They outlive config reloads, so stored variants are not listed again.
+var cacheIndexes = caddy.NewUsagePool()
+
+// CacheOptions configure the persistent cache of processed images.
+// Variants are stored in a Caddy storage module (the global storage by default)
+// and evicted in least recently used order once MaxSize is reached.
+type CacheOptions struct {
+	StorageRaw   json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	Prefix       string          `json:"prefix,omitempty"`
+	MaxSize      int64           `json:"max_size,omitempty"`
+	MaxEntrySize int64           `json:"max_entry_size,omitempty"`
+
+	storage  certmagic.Storage
+	logger   *zap.Logger
+	indexKey string
+	index    *cacheIndex
+}
+
+// cacheIndex tracks stored variants in least recently used order.
+// It is filled in the background from the storage, lookups fall back to the storage until then.
+type cacheIndex struct {
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	maxSize int64
+	loaded  bool
+
+	cancel context.CancelFunc
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// Destruct stops loading the index once no handler uses it
+func (i *cacheIndex) Destruct() error {
+	i.cancel()
+	return nil
+}
+
+// Provision loads the storage module and the LRU index of stored variants
+func (c *CacheOptions) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger()
+	c.Prefix = cmp.Or(c.Prefix, defaultCachePrefix)
+	c.MaxSize = cmp.Or(c.MaxSize, defaultCacheMaxSize)
+
+	if c.StorageRaw != nil {
+		val, err := ctx.LoadModule(c, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading cache storage module: %v", err)
+		}
+		c.storage, err = val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating cache storage: %v", err)
+		}
+	} else {
+		c.storage = ctx.Storage()
+	}
+
+	// Handlers with the same storage and prefix share the index and its size budget
+	c.indexKey = string(c.StorageRaw) + "\x00" + c.Prefix
+	value, _, err := cacheIndexes.LoadOrNew(c.indexKey, func() (caddy.Destructor, error) {
+		loadCtx, cancel := context.WithCancel(context.Background())
+		index := &cacheIndex{
+			lru:     list.New(),
+			entries: make(map[string]*list.Element),
+			cancel:  cancel,
+		}
+		go c.loadIndex(loadCtx, index)
+		return index, nil
+	})
+	if err != nil {
+		return err
+	}
+	c.index = value.(*cacheIndex)
+
+	// Latest configuration defines the size budget
+	c.index.mu.Lock()
+	c.index.maxSize = c.MaxSize
+	c.index.mu.Unlock()
+	return nil
+}
+
+// Cleanup releases the shared index
+func (c *CacheOptions) Cleanup() error {
+	if c.index == nil {
+		return nil
+	}
+	_, err := cacheIndexes.Delete(c.indexKey)
+	return err
+}
+
+// Validate ensure cache parameters are correctly defined
+func (c *CacheOptions) Validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("cache 'max_size' must be positive")
+	}
+	if c.MaxEntrySize < 0 {
+		return fmt.Errorf("cache 'max_entry_size' must be positive")
+	}
+	if c.MaxEntrySize > c.MaxSize {
+		return fmt.Errorf("cache 'max_entry_size' cannot be greater than 'max_size'")
+	}
+	return nil
+}
+
+// loadIndex lists already stored variants and adds them to the index, behind the ones stored meanwhile.
+func (c *CacheOptions) loadIndex(ctx context.Context, index *cacheIndex) {
+	keys, err := c.storage.List(ctx, c.Prefix, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logger.Warn("error listing cache storage", zap.Error(err))
+	}
+
+	var infos []certmagic.KeyInfo
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		info, err := c.storage.Stat(ctx, key)
+		if err != nil || !info.IsTerminal {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	// Most recently modified first
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Modified.After(infos[j].Modified)
+	})
+
+	index.mu.Lock()
+	for _, info := range infos {
+		if _, exists := index.entries[info.Key]; exists {
+			continue
+		}
+		index.entries[info.Key] = index.lru.PushBack(&cacheEntry{key: info.Key, size: info.Size})
+		index.size += info.Size
+	}
+	index.loaded = true
+	victims := index.evict()
+	index.mu.Unlock()
+
+	c.deleteKeys(ctx, victims)
+}
+
+// getVariantKey returns the key identifying a processed variant in caches.
+// It is derived from the requested resource, the source version (its ETag or content hash),
+// the canonical form and the configuration fingerprint.
+func getVariantKey(r *http.Request, sourceVersion string, form *url.Values, configFingerprint string) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Host + "\x00" + r.URL.Path + "\x00" + sourceVersion + "\x00" + getCanonicalForm(form)))
+	if configFingerprint != "" {
+		hash.Write([]byte("\x00" + configFingerprint))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get returns the content type and body of a cached variant
+func (c *CacheOptions) Get(ctx context.Context, variantKey string) (string, []byte, bool) {
+	key := c.storageKey(variantKey)
+
+	c.index.mu.Lock()
+	element, exists := c.index.entries[key]
+	if exists {
+		c.index.lru.MoveToFront(element)
+	}
+	loaded := c.index.loaded
+	c.index.mu.Unlock()
+
+	// Until the index is loaded, variants may be stored without being indexed yet
+	if !exists && loaded {
+		stats.Add("cache_misses", 1)
+		return "", nil, false
+	}
+
+	value, err := c.storage.Load(ctx, key)
+	if err != nil {
+		if exists {
+			c.logger.Warn("error loading cached image", zap.String("key", key), zap.Error(err))
+			c.index.remove(key)
+		}
+		stats.Add("cache_misses", 1)
+		return "", nil, false
+	}
+
+	contentType, body, found := bytes.Cut(value, []byte("\n"))
+	if !found {
+		c.index.remove(key)
+		stats.Add("cache_misses", 1)
+		return "", nil, false
+	}
+
+	if !exists {
+		c.index.mu.Lock()
+		c.index.add(key, int64(len(value)))
+		victims := c.index.evict()
+		c.index.mu.Unlock()
+		c.deleteKeys(ctx, victims)
+	}
+
+	stats.Add("cache_hits", 1)
+	return string(contentType), body, true
+}
+
+// Set stores a processed variant and evicts least recently used ones if the cache is full
+func (c *CacheOptions) Set(ctx context.Context, variantKey string, contentType string, body []byte) {
+	key := c.storageKey(variantKey)
+
+	value := make([]byte, 0, len(contentType)+1+len(body))
+	value = append(value, contentType...)
+	value = append(value, '\n')
+	value = append(value, body...)
+
+	size := int64(len(value))
+	if size > c.MaxSize || (c.MaxEntrySize > 0 && size > c.MaxEntrySize) {
+		return
+	}
+
+	if err := c.storage.Store(ctx, key, value); err != nil {
+		c.logger.Warn("error storing cached image", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	c.index.mu.Lock()
+	c.index.add(key, size)
+	victims := c.index.evict()
+	c.index.mu.Unlock()
+
+	c.deleteKeys(ctx, victims)
+}
+
+// add indexes a variant as the most recently used one, the caller must hold the lock
+func (i *cacheIndex) add(key string, size int64) {
+	if element, exists := i.entries[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		i.size += size - entry.size
+		entry.size = size
+		i.lru.MoveToFront(element)
+		return
+	}
+	i.entries[key] = i.lru.PushFront(&cacheEntry{key: key, size: size})
+	i.size += size
+}
+
+// evict removes least recently used entries from the index until the cache fits in maxSize.
+// The caller must hold the lock and delete returned keys from the storage.
+func (i *cacheIndex) evict() []string {
+	var victims []string
+	for i.size > i.maxSize {
+		element := i.lru.Back()
+		if element == nil {
+			break
+		}
+		entry := i.lru.Remove(element).(*cacheEntry)
+		delete(i.entries, entry.key)
+		i.size -= entry.size
+		victims = append(victims, entry.key)
+	}
+	return victims
+}
+
+// storageKey shards variants in sub-directories to avoid huge listings
+func (c *CacheOptions) storageKey(variantKey string) string {
+	return path.Join(c.Prefix, variantKey[:2], variantKey)
+}
+
+func (i *cacheIndex) remove(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if element, exists := i.entries[key]; exists {
+		i.size -= i.lru.Remove(element).(*cacheEntry).size
+		delete(i.entries, key)
+	}
+}
+
+func (c *CacheOptions) deleteKeys(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := c.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.logger.Warn("error evicting cached image", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+func (c *CacheOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "storage":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
+			if err != nil {
+				return err
+			}
+			storage, ok := unm.(caddy.StorageConverter)
+			if !ok {
+				return d.Errf("module caddy.storage.%s is not a caddy.StorageConverter", name)
+			}
+			c.StorageRaw = caddyconfig.JSONModuleObject(storage, "module", name, nil)
+		case "prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Prefix = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_size", "max_entry_size":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid value for %s: %v", option, err)
+			}
+			if option == "max_size" {
+				c.MaxSize = int64(size)
+			} else {
+				c.MaxEntrySize = int64(size)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unexpected directive '%s' in cache block", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package CADDY_FILE_SERVER
+
+import (
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "image-sign",
+		Usage: "--path <path> [--key <secret>] [--key-id <id>] [--expires <duration>] [--base <url>] [<param>=<value>...] | --verify <url>",
+		Short: "Generates or verifies signed image processing urls",
+		Long: `
+Generates an url signed the same way the image_processor security
+signing verifies it, and writes it to stdout.
+
+--key is the secret used to sign, when omitted it is read from the
+IMAGE_SIGNING_KEY environment variable.
+
+--key-id adds the 'kid' parameter, required to select the right key
+when several keys are configured.
+
+--expires adds the 'exp' parameter, the url is rejected after this
+duration (e.g. 24h).
+
+--base is prepended to the path (e.g. https://cdn.example.com).
+
+Remaining arguments are processing parameters (e.g. w=400 fm=webp)
+or a preset (e.g. p=card).
+
+With --verify, the given url is checked instead and the reason of
+the failure is explained.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("path", "p", "", "Path of the image")
+			cmd.Flags().StringP("key", "k", "", "Secret used to sign the url")
+			cmd.Flags().StringP("key-id", "i", "", "Id of the key, added as 'kid' parameter")
+			cmd.Flags().DurationP("expires", "e", 0, "Validity of the url, added as 'exp' parameter")
+			cmd.Flags().StringP("base", "b", "", "Base url prepended to the path")
+			cmd.Flags().String("verify", "", "Signed url to verify")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdImageSign)
+		},
+	})
+}
+
+func cmdImageSign(fs caddycmd.Flags) (int, error) {
+	secret := fs.String("key")
+	if secret == "" {
+		secret = os.Getenv("IMAGE_SIGNING_KEY")
+	}
+	if secret == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("a key is required, use --key or IMAGE_SIGNING_KEY environment variable")
+	}
+
+	keyID := fs.String("key-id")
+	signing := &SigningOptions{Keys: map[string]string{keyID: secret}}
+
+	if rawURL := fs.String("verify"); rawURL != "" {
+		return cmdImageVerify(signing, keyID, rawURL)
+	}
+
+	path := fs.String("path")
+	if path == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--path is required")
+	}
+
+	form := url.Values{}
+	for _, arg := range fs.Args() {
+		param, value, found := strings.Cut(arg, "=")
+		if !found {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid parameter '%s', expected <param>=<value>", arg)
+		}
+		if !slices.Contains(availableParams, param) && param != presetParam {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown parameter '%s'", param)
+		}
+		form.Set(param, value)
+	}
+
+	if keyID != "" {
+		form.Set(keyIDParam, keyID)
+	}
+	if expires := fs.Duration("expires"); expires > 0 {
+		form.Set(expiresParam, strconv.FormatInt(time.Now().Add(expires).Unix(), 10))
+	}
+
+	signature, err := signing.Sign(keyID, path, form)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	form.Set(signatureParam, signature)
+
+	// The unescaped path is signed, as verified against the decoded request path
+	escapedPath := (&url.URL{Path: path}).EscapedPath()
+	fmt.Println(strings.TrimSuffix(fs.String("base"), "/") + escapedPath + "?" + form.Encode())
+	return 0, nil
+}
+
+func cmdImageVerify(signing *SigningOptions, keyID string, rawURL string) (int, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid url: %v", err)
+	}
+	form := u.Query()
+
+	fmt.Printf("signed payload: %s\n", getSignaturePayload(u.Path, form))
+	for param := range form {
+		if param != signatureParam && !slices.Contains(availableParams, param) && !slices.Contains(signedParams, param) {
+			fmt.Printf("ignored parameter: '%s' is not covered by the signature\n", param)
+		}
+	}
+
+	if urlKeyID := form.Get(keyIDParam); urlKeyID != keyID {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("key id mismatch: url uses '%s' but '%s' was provided with --key-id", urlKeyID, keyID)
+	}
+
+	if err := signing.Verify(u.Path, form); err != nil {
+		if errors.Is(err, ExpiredSignatureError) {
+			expires, _ := strconv.ParseInt(form.Get(expiresParam), 10, 64)
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("signature is valid but has expired at %s", time.Unix(expires, 0).Format(time.RFC3339))
+		}
+		if errors.Is(err, InvalidSignatureError) {
+			expected, _ := signing.Sign(keyID, u.Path, form)
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid signature: got '%s', expected '%s' for this key", form.Get(signatureParam), expected)
+		}
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Println("signature is valid")
+	return 0, nil
+}
@@ -0,0 +1,46 @@
+package CADDY_FILE_SERVER
+
+import (
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"slices"
+	"strings"
+)
+
+func init() {
+	RegisterConstraintType(func() Constraint {
+		return new(EnumConstraint)
+	})
+}
+
+type EnumConstraint struct {
+	Values []string `json:"values"`
+}
+
+func (r *EnumConstraint) ID() string {
+	return "enum"
+}
+
+func (r *EnumConstraint) Validate(param string) error {
+	if !slices.Contains([]string{"fit", "pos", "gr", "fm", "bg", "wmt"}, param) {
+		return fmt.Errorf("enum constraint cannot be applied on param: '%s'", param)
+	}
+	if len(r.Values) == 0 {
+		return errors.New("you need to provide at least one value for enum constraint")
+	}
+	return nil
+}
+
+func (r *EnumConstraint) ValidateParam(param string, value string) error {
+	if !slices.Contains(r.Values, value) {
+		return fmt.Errorf("%s must be one of %s", param, strings.Join(r.Values, ", "))
+	}
+
+	return nil
+}
+
+func (r *EnumConstraint) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	r.Values = d.RemainingArgs()
+	return nil
+}
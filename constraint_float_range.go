@@ -0,0 +1,104 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"slices"
+	"strconv"
+)
+
+func init() {
+	RegisterConstraintType(func() Constraint {
+		return new(FloatRangeConstraint)
+	})
+}
+
+type FloatRangeConstraint struct {
+	From float64 `json:"from,omitempty"`
+	To   float64 `json:"to,omitempty"`
+}
+
+func (r *FloatRangeConstraint) ID() string {
+	return "float_range"
+}
+
+func (r *FloatRangeConstraint) Validate(param string) error {
+	if !slices.Contains([]string{"fpx", "fpy", "dpr", "th", "g", "br", "c"}, param) {
+		return fmt.Errorf("float_range constraint cannot be applied on param: '%s'", param)
+	}
+	if r.From >= r.To {
+		return fmt.Errorf("float_range constraint must have minimum value less than max")
+	}
+	return nil
+}
+
+func (r *FloatRangeConstraint) ValidateParam(param string, value string) error {
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid float value for %s: %s", param, value)
+	}
+
+	if floatValue < r.From || floatValue > r.To {
+		return fmt.Errorf("%s must be in range %g to %g", param, r.From, r.To)
+	}
+
+	return nil
+}
+
+func (r *FloatRangeConstraint) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	var nested bool
+
+	// Try to load nested block if present
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		nested = true
+		param := d.Val()
+
+		switch param {
+		case "from":
+			if !d.NextArg() {
+				return d.Err("missing value for from")
+			}
+			var err error
+			r.From, err = strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid from value for float_range: %v", err)
+			}
+		case "to":
+			if !d.NextArg() {
+				return d.Err("missing value for to")
+			}
+			var err error
+			r.To, err = strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid to value for float_range: %v", err)
+			}
+		default:
+			return d.Errf("unexpected parameter '%s' in float_range constraint", param)
+		}
+	}
+
+	// If not a nested block, process inline arguments
+	if !nested {
+		if !d.NextArg() {
+			return d.Err("missing from value for float_range constraint")
+		}
+		var err error
+		r.From, err = strconv.ParseFloat(d.Val(), 64)
+		if err != nil {
+			return d.Errf("invalid from value for float_range: %v", err)
+		}
+
+		if !d.NextArg() {
+			return d.Err("missing to value for float_range constraint")
+		}
+		r.To, err = strconv.ParseFloat(d.Val(), 64)
+		if err != nil {
+			return d.Errf("invalid to value for float_range: %v", err)
+		}
+
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
@@ -23,7 +23,7 @@ func (r *RangeConstraint) ID() string {
 }
 
 func (r *RangeConstraint) Validate(param string) error {
-	if !slices.Contains([]string{"w", "h", "q", "ah", "aw", "t", "l", "r", "b"}, param) {
+	if !slices.Contains([]string{"w", "h", "q", "ah", "aw", "t", "l", "r", "b", "bhx", "bhy"}, param) {
 		return fmt.Errorf("range constraint cannot be applied on param: '%s'", param)
 	}
 	if r.From < 0 {
@@ -23,7 +23,7 @@ func (r *ValuesConstraint) ID() string {
 }
 
 func (r *ValuesConstraint) Validate(param string) error {
-	if !slices.Contains([]string{"w", "h", "q", "ah", "aw", "t", "l", "r", "b"}, param) {
+	if !slices.Contains([]string{"w", "h", "q", "ah", "aw", "t", "l", "r", "b", "bhx", "bhy"}, param) {
 		return fmt.Errorf("values constraint cannot be applied on param: '%s'", param)
 	}
 	if len(r.Values) == 0 {
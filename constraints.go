@@ -158,14 +158,17 @@ func (cs *Constraints) ProcessRequestForm(form *url.Values, onSecurityFail OnSec
 		}
 
 		for _, constraint := range constraints {
-			if err := constraint.ValidateParam(param, form.Get(param)); err != nil {
+			// Sizes are constrained once multiplied by the device pixel ratio
+			if err := constraint.ValidateParam(param, getEffectiveParamValue(form, param)); err != nil {
 				if onSecurityFail == OnSecurityFailIgnore {
 					form.Del(param)
 				} else if onSecurityFail == OnSecurityFailBypass {
 					return BypassRequestError
 				} else if onSecurityFail == OnSecurityFailAbort {
 					return &AbortRequestError{
-						err.Error(),
+						Msg:        err.Error(),
+						Param:      param,
+						Constraint: constraint,
 					}
 				}
 
@@ -0,0 +1,70 @@
+package CADDY_FILE_SERVER
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// acceptClientHints lists client hints requested from browsers when client_hints is enabled
+const acceptClientHints = "Sec-CH-DPR, Sec-CH-Width, DPR, Width"
+
+// applyClientHints fills 'dpr' and 'w' from client hints headers if they are not provided.
+// It returns the request headers the response depends on.
+func applyClientHints(r *http.Request, form *url.Values) []string {
+	var vary []string
+
+	if !form.Has("dpr") {
+		vary = append(vary, "Sec-CH-DPR", "DPR")
+		if dpr := getClientHint(r, "Sec-CH-DPR", "DPR"); dpr != "" {
+			form.Set("dpr", dpr)
+		}
+	}
+
+	if !form.Has("w") {
+		vary = append(vary, "Sec-CH-Width", "Width")
+		if width := getClientHint(r, "Sec-CH-Width", "Width"); width != "" {
+			// Width hint is already expressed in physical pixels, 'h' is converted so both use the same unit
+			if form.Has("h") {
+				form.Set("h", getEffectiveParamValue(form, "h"))
+			}
+			form.Set("w", width)
+			form.Del("dpr")
+		}
+	}
+
+	return vary
+}
+
+func getClientHint(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// getEffectiveParamValue returns the value of 'w' and 'h' multiplied by 'dpr', as used for processing.
+// Other parameters, or invalid values, are returned as is.
+func getEffectiveParamValue(form *url.Values, param string) string {
+	value := form.Get(param)
+	if (param != "w" && param != "h") || !form.Has("dpr") {
+		return value
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return value
+	}
+	dpr, err := strconv.ParseFloat(form.Get("dpr"), 64)
+	if err != nil || dpr <= 0 {
+		return value
+	}
+	return strconv.Itoa(applyDevicePixelRatio(size, dpr))
+}
+
+func applyDevicePixelRatio(size int, dpr float64) int {
+	return int(math.Round(float64(size) * dpr))
+}
@@ -1,16 +1,95 @@
 package CADDY_FILE_SERVER
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 )
 
+// AbortRequestError stops the request with Status (400 Bad Request if not defined).
+// Param and Constraint optionally identify the parameter and the constraint that failed.
 type AbortRequestError struct {
-	Msg string
+	Msg        string
+	Status     int
+	Param      string
+	Constraint Constraint
 }
 
 func (e *AbortRequestError) Error() string {
 	return fmt.Sprintf("request aborted: %s", e.Msg)
 }
 
+// MarshalJSON describes the abort reason, with the failed constraint and its configuration if any
+func (e *AbortRequestError) MarshalJSON() ([]byte, error) {
+	response := struct {
+		Error      string     `json:"error"`
+		Param      string     `json:"param,omitempty"`
+		Constraint string     `json:"constraint,omitempty"`
+		Details    Constraint `json:"details,omitempty"`
+	}{
+		Error:   e.Msg,
+		Param:   e.Param,
+		Details: e.Constraint,
+	}
+	if e.Constraint != nil {
+		response.Constraint = e.Constraint.ID()
+	}
+	return json.Marshal(response)
+}
+
 var BypassRequestError = errors.New("bypass request")
+
+var InvalidSignatureError = errors.New("invalid signature")
+
+var ExpiredSignatureError = errors.New("signature expired")
+
+var QueueFullError = errors.New("processing queue is full")
+
+var QueueTimeoutError = errors.New("timed out waiting for a processing slot")
+
+var InputTooLargeError = errors.New("input image exceeds max_input_bytes")
+
+var InputPixelsError = errors.New("input image exceeds max_input_pixels")
+
+var OutputPixelsError = errors.New("output image exceeds max_output_pixels")
+
+var InputFormatError = errors.New("input image format is not allowed")
+
+// Machine-readable codes of invalid parameters
+const (
+	InvalidParamCodeInteger = "invalid_integer"
+	InvalidParamCodeBoolean = "invalid_boolean"
+	InvalidParamCodeFloat   = "invalid_float"
+	InvalidParamCodeValue   = "invalid_value"
+	InvalidParamCodeRange   = "out_of_range"
+)
+
+// InvalidParam describes a parameter whose value cannot be parsed
+type InvalidParam struct {
+	Param string `json:"param"`
+	Code  string `json:"code"`
+	Msg   string `json:"message"`
+}
+
+// InvalidParamsError lists every invalid parameter of a request
+type InvalidParamsError struct {
+	Params []InvalidParam `json:"errors"`
+}
+
+// add inserts an invalid parameter, keeping them sorted by name
+func (e *InvalidParamsError) add(param string, code string, msg string) {
+	i, _ := slices.BinarySearchFunc(e.Params, param, func(invalidParam InvalidParam, param string) int {
+		return strings.Compare(invalidParam.Param, param)
+	})
+	e.Params = slices.Insert(e.Params, i, InvalidParam{Param: param, Code: code, Msg: msg})
+}
+
+func (e *InvalidParamsError) Error() string {
+	messages := make([]string, len(e.Params))
+	for i, invalidParam := range e.Params {
+		messages[i] = invalidParam.Msg
+	}
+	return fmt.Sprintf("invalid parameters: %s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,101 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/h2non/bimg"
+	"math"
+)
+
+// Fit represents how the image is resized when both width and height are provided (same as sharp).
+type Fit string
+
+const (
+	// FitCover crops the image to cover both dimensions, preserving aspect ratio.
+	FitCover Fit = "cover"
+
+	// FitContain embeds the image within both dimensions, preserving aspect ratio.
+	FitContain Fit = "contain"
+
+	// FitFill stretches the image to both dimensions, ignoring aspect ratio.
+	FitFill Fit = "fill"
+
+	// FitInside resizes the image to be as large as possible while being smaller or equal to both dimensions.
+	FitInside Fit = "inside"
+
+	// FitOutside resizes the image to be as small as possible while being larger or equal to both dimensions.
+	FitOutside Fit = "outside"
+)
+
+// gravities maps the accepted 'pos' values to bimg gravities, including sharp aliases.
+var gravities = map[string]bimg.Gravity{
+	"centre":    bimg.GravityCentre,
+	"center":    bimg.GravityCentre,
+	"north":     bimg.GravityNorth,
+	"top":       bimg.GravityNorth,
+	"east":      bimg.GravityEast,
+	"right":     bimg.GravityEast,
+	"south":     bimg.GravitySouth,
+	"bottom":    bimg.GravitySouth,
+	"west":      bimg.GravityWest,
+	"left":      bimg.GravityWest,
+	"smart":     bimg.GravitySmart,
+	"entropy":   bimg.GravitySmart,
+	"attention": bimg.GravitySmart,
+}
+
+// applyFit maps the fit mode onto bimg options, fit only applies when both dimensions are provided.
+func (o *imageOptions) applyFit() {
+	if o.Fit == "" || o.Width <= 0 || o.Height <= 0 {
+		return
+	}
+
+	o.Crop, o.Embed, o.Force = false, false, false
+	switch o.Fit {
+	case FitCover:
+		o.Crop = true
+	case FitContain:
+		o.Embed = true
+		o.Extend = bimg.ExtendBackground
+	case FitFill:
+		o.Force = true
+	case FitInside, FitOutside:
+		// Dimensions are resolved from the image size, bimg would stretch the image otherwise
+	}
+}
+
+// needsSize returns true if the fit mode depends on the image size
+func (o *imageOptions) needsSize() bool {
+	return (o.Fit == FitInside || o.Fit == FitOutside) && o.Width > 0 && o.Height > 0
+}
+
+// resolveFit computes the dimensions of the 'inside' and 'outside' fit modes from the image size.
+func (o *imageOptions) resolveFit(metadata bimg.ImageMetadata) {
+	if !o.needsSize() {
+		return
+	}
+
+	width, height := float64(metadata.Size.Width), float64(metadata.Size.Height)
+	if metadata.Orientation >= 5 && !o.NoAutoRotate {
+		// Image will be rotated by 90 or 270 degrees
+		width, height = height, width
+	}
+	if width == 0 || height == 0 {
+		return
+	}
+
+	ratio := math.Min(float64(o.Width)/width, float64(o.Height)/height)
+	if o.Fit == FitOutside {
+		ratio = math.Max(float64(o.Width)/width, float64(o.Height)/height)
+	}
+	o.Width = int(math.Round(width * ratio))
+	o.Height = int(math.Round(height * ratio))
+}
+
+func parseFit(value string) (Fit, error) {
+	switch fit := Fit(value); fit {
+	case FitCover, FitContain, FitFill, FitInside, FitOutside:
+		return fit, nil
+	default:
+		return "", fmt.Errorf("possible values for 'fit' are cover, contain, fill, inside, outside")
+	}
+}
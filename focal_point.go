@@ -0,0 +1,50 @@
+package CADDY_FILE_SERVER
+
+import (
+	"github.com/h2non/bimg"
+	"math"
+)
+
+// usesFocalPoint returns true if the crop window must be placed around the focal point.
+// It takes precedence over gravity when cropping to both dimensions.
+func (o *imageOptions) usesFocalPoint() bool {
+	return o.FocalPoint && o.Crop && o.Width > 0 && o.Height > 0
+}
+
+// resolveFocalPoint replaces the crop by a resize followed by the extraction of the area
+// keeping the focal point as centered as possible.
+func (o *imageOptions) resolveFocalPoint(metadata bimg.ImageMetadata) {
+	if !o.usesFocalPoint() {
+		return
+	}
+
+	width, height := float64(metadata.Size.Width), float64(metadata.Size.Height)
+	if metadata.Orientation >= 5 && !o.NoAutoRotate {
+		// Image will be rotated by 90 or 270 degrees
+		width, height = height, width
+	}
+	if width == 0 || height == 0 {
+		return
+	}
+
+	// Scale the image to cover the crop window
+	scale := math.Max(float64(o.Width)/width, float64(o.Height)/height)
+	if scale > 1 && !o.Enlarge {
+		scale = 1
+	}
+	scaledWidth := int(math.Round(width * scale))
+	scaledHeight := int(math.Round(height * scale))
+
+	areaWidth := min(o.Width, scaledWidth)
+	areaHeight := min(o.Height, scaledHeight)
+
+	left := int(math.Round(o.FocalX*float64(scaledWidth) - float64(areaWidth)/2))
+	top := int(math.Round(o.FocalY*float64(scaledHeight) - float64(areaHeight)/2))
+
+	o.Width, o.Height = scaledWidth, scaledHeight
+	o.Left = max(0, min(left, scaledWidth-areaWidth))
+	o.Top = max(0, min(top, scaledHeight-areaHeight))
+	o.AreaWidth, o.AreaHeight = areaWidth, areaHeight
+	o.Crop, o.Embed = false, false
+	o.Gravity = bimg.GravityCentre
+}
@@ -2,14 +2,16 @@ package CADDY_FILE_SERVER
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/cespare/xxhash/v2"
+	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 )
 
-func getProcessedImageEtag(initialEtag string, form *url.Values) string {
+func getProcessedImageEtag(initialEtag string, form *url.Values, configFingerprint string) string {
 	// Return early if the initial ETag is empty
 	if initialEtag == "" {
 		return ""
@@ -21,6 +23,43 @@ func getProcessedImageEtag(initialEtag string, form *url.Values) string {
 		return initialEtag
 	}
 
+	// Generate the hash of the concatenated parameters
+	hash := xxhash.New()
+	_, err := hash.WriteString(getCanonicalForm(form))
+	if err != nil {
+		return ""
+	}
+	if configFingerprint != "" {
+		hash.WriteString("\x00" + configFingerprint)
+	}
+	hashString := fmt.Sprintf("%x", hash.Sum(nil))
+	return matches[1] + matches[2] + "-" + hashString + matches[3]
+}
+
+// getConfigFingerprint hashes the configuration applied to processed images without being part of the url,
+// so that cached variants and ETags change with it. It is empty when no such configuration is set.
+func getConfigFingerprint(watermark *WatermarkOptions, textWatermark *TextWatermarkOptions) (string, error) {
+	if watermark == nil && textWatermark == nil {
+		return "", nil
+	}
+
+	hash := xxhash.New()
+	for _, options := range []any{watermark, textWatermark} {
+		config, err := json.Marshal(options)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(config)
+	}
+	if watermark != nil {
+		hash.Write(watermark.overlay)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// getCanonicalForm returns the form parameters sorted and concatenated,
+// so that two equivalent requests always share the same representation.
+func getCanonicalForm(form *url.Values) string {
 	var params []string
 	for key, values := range *form {
 		params = append(params, key+"="+values[0])
@@ -34,13 +73,13 @@ func getProcessedImageEtag(initialEtag string, form *url.Values) string {
 	for _, param := range params {
 		buffer.WriteString(param)
 	}
+	return buffer.String()
+}
 
-	// Generate the hash of the concatenated parameters
-	hash := xxhash.New()
-	_, err := hash.Write(buffer.Bytes())
-	if err != nil {
-		return ""
+// setVaryHeader replaces the proxied Vary header with the request headers the processed image depends on
+func setVaryHeader(header http.Header, vary []string) {
+	header.Del("Vary")
+	for _, value := range vary {
+		header.Add("Vary", value)
 	}
-	hashString := fmt.Sprintf("%x", hash.Sum(nil))
-	return matches[1] + matches[2] + "-" + hashString + matches[3]
 }
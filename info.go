@@ -0,0 +1,70 @@
+package CADDY_FILE_SERVER
+
+import (
+	"encoding/json"
+	"github.com/h2non/bimg"
+)
+
+// imageInfo is the JSON response of 'info=1'
+type imageInfo struct {
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	Format      string       `json:"format"`
+	Space       string       `json:"color_space"`
+	Channels    int          `json:"channels"`
+	Alpha       bool         `json:"alpha"`
+	Profile     bool         `json:"icc_profile"`
+	Orientation int          `json:"orientation"`
+	Bytes       int          `json:"bytes"`
+	EXIF        *exifSummary `json:"exif,omitempty"`
+}
+
+// exifSummary lists common EXIF fields, GPS coordinates are never exposed
+type exifSummary struct {
+	Make             string `json:"make,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Software         string `json:"software,omitempty"`
+	DateTimeOriginal string `json:"date_time_original,omitempty"`
+	ExposureTime     string `json:"exposure_time,omitempty"`
+	FNumber          string `json:"f_number,omitempty"`
+	ISOSpeedRatings  int    `json:"iso,omitempty"`
+	FocalLength      string `json:"focal_length,omitempty"`
+	GPS              bool   `json:"gps,omitempty"`
+}
+
+// getImageInfo reads the image header and returns its metadata as JSON
+func getImageInfo(decoded []byte) ([]byte, error) {
+	metadata, err := bimg.Metadata(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	info := imageInfo{
+		Width:       metadata.Size.Width,
+		Height:      metadata.Size.Height,
+		Format:      metadata.Type,
+		Space:       metadata.Space,
+		Channels:    metadata.Channels,
+		Alpha:       metadata.Alpha,
+		Profile:     metadata.Profile,
+		Orientation: metadata.Orientation,
+		Bytes:       len(decoded),
+	}
+
+	exif := exifSummary{
+		Make:             metadata.EXIF.Make,
+		Model:            metadata.EXIF.Model,
+		Software:         metadata.EXIF.Software,
+		DateTimeOriginal: metadata.EXIF.DateTimeOriginal,
+		ExposureTime:     metadata.EXIF.ExposureTime,
+		FNumber:          metadata.EXIF.FNumber,
+		ISOSpeedRatings:  metadata.EXIF.ISOSpeedRatings,
+		FocalLength:      metadata.EXIF.FocalLength,
+		GPS:              metadata.EXIF.GPSLatitude != "" || metadata.EXIF.GPSLongitude != "",
+	}
+	if exif != (exifSummary{}) {
+		info.EXIF = &exif
+	}
+
+	return json.Marshal(info)
+}
@@ -0,0 +1,60 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/h2non/bimg"
+	"net/http"
+	"slices"
+)
+
+// OnInputFormat represents the possible values for the "on_input_format" directive.
+type OnInputFormat string
+
+const (
+	// OnInputFormatBypass returns the initial (unprocessed) image.
+	OnInputFormatBypass OnInputFormat = "bypass"
+
+	// OnInputFormatReject returns a 415 Unsupported Media Type to the client.
+	OnInputFormatReject OnInputFormat = "reject"
+)
+
+// checkInputFormat ensures the source image format is allowed by input_formats before libvips decodes it
+func (m *Middleware) checkInputFormat(decoded []byte) error {
+	if len(m.InputFormats) == 0 {
+		return nil
+	}
+
+	format := bimg.ImageTypeName(bimg.DetermineImageType(decoded))
+	if !slices.Contains(m.InputFormats, format) {
+		return fmt.Errorf("%w: %s", InputFormatError, format)
+	}
+	return nil
+}
+
+// handleInputFormatError serves the initial image or rejects the request depending on on_input_format
+func (m *Middleware) handleInputFormatError(w http.ResponseWriter, err error, responseRecorder caddyhttp.ResponseRecorder) error {
+	if m.OnInputFormat == OnInputFormatReject {
+		observeOutcome(outcomeInputFormatReject)
+		removeInitialHeaders(w.Header())
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	observeOutcome(outcomeInputFormatBypass)
+	return responseRecorder.WriteResponse()
+}
+
+// validateInputFormats ensures formats are image types known by bimg
+func validateInputFormats(formats []string) error {
+	for _, format := range formats {
+		known := false
+		for _, name := range bimg.ImageTypes {
+			known = known || name == format
+		}
+		if !known {
+			return fmt.Errorf("invalid value in input_formats: '%s' (expected jpeg, png, webp, tiff, gif, pdf, svg, magick, heif or avif)", format)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package CADDY_FILE_SERVER
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// OnQueueFull represents the possible values for the "on_queue_full" directive.
+type OnQueueFull string
+
+const (
+	// OnQueueFullBypass returns the initial (unprocessed) image.
+	OnQueueFullBypass OnQueueFull = "bypass"
+
+	// OnQueueFullReject returns a 503 Service Unavailable with a Retry-After header.
+	OnQueueFullReject OnQueueFull = "reject"
+
+	// OnQueueFullWait ignores max_queue, requests wait for a slot until queue_timeout.
+	OnQueueFullWait OnQueueFull = "wait"
+)
+
+// limiter bounds the number of concurrent libvips jobs, extra jobs wait in a bounded queue
+type limiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+	timeout  time.Duration
+	wait     bool
+}
+
+func newLimiter(maxConcurrent int, maxQueue int, timeout time.Duration, onQueueFull OnQueueFull) *limiter {
+	return &limiter{
+		slots:    make(chan struct{}, maxConcurrent),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+		wait:     onQueueFull == OnQueueFullWait,
+	}
+}
+
+// acquire waits for a processing slot. It returns QueueFullError if the queue is full,
+// QueueTimeoutError if no slot was freed before the queue timeout, or the context error.
+func (l *limiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if queued := l.queued.Add(1); !l.wait && queued > l.maxQueue {
+		l.queued.Add(-1)
+		imageMetrics.queueRejections.WithLabelValues("full").Inc()
+		return QueueFullError
+	}
+	imageMetrics.queueDepth.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		imageMetrics.queueDepth.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		imageMetrics.queueRejections.WithLabelValues("timeout").Inc()
+		return QueueTimeoutError
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a processing slot
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// handleQueueFull serves the initial image or a 503 response when no processing slot is available
+func (m *Middleware) handleQueueFull(w http.ResponseWriter, responseRecorder caddyhttp.ResponseRecorder) error {
+	if m.OnQueueFull == OnQueueFullReject {
+		observeOutcome(outcomeQueueReject)
+		retryAfter := max(1, int(math.Ceil(time.Duration(m.QueueTimeout).Seconds())))
+		removeInitialHeaders(w.Header())
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	observeOutcome(outcomeQueueBypass)
+	return responseRecorder.WriteResponse()
+}
@@ -0,0 +1,87 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/h2non/bimg"
+	"math"
+)
+
+// checkInputPixels ensures the source image does not exceed max_input_pixels,
+// the size is read from the image header so the image is not fully decoded.
+func (m *Middleware) checkInputPixels(decoded []byte) error {
+	if m.MaxInputPixels == 0 {
+		return nil
+	}
+
+	size, err := bimg.Size(decoded)
+	if err != nil {
+		return err
+	}
+	if pixels := int64(size.Width) * int64(size.Height); pixels > m.MaxInputPixels {
+		return fmt.Errorf("%w: %dx%d", InputPixelsError, size.Width, size.Height)
+	}
+	return nil
+}
+
+// checkOutputPixels ensures an output size does not exceed max_output_pixels
+func (m *Middleware) checkOutputPixels(width int, height int) error {
+	if m.MaxOutputPixels == 0 {
+		return nil
+	}
+
+	if pixels := int64(width) * int64(height); pixels > m.MaxOutputPixels {
+		return fmt.Errorf("%w: %dx%d", OutputPixelsError, width, height)
+	}
+	return nil
+}
+
+// checkEstimatedOutputPixels rejects options whose images would exceed max_output_pixels, before libvips allocates them
+func (m *Middleware) checkEstimatedOutputPixels(options imageOptions, metadata bimg.ImageMetadata) error {
+	if m.MaxOutputPixels == 0 {
+		return nil
+	}
+
+	if pixels := estimateOutputPixels(options, metadata); pixels > float64(m.MaxOutputPixels) {
+		return fmt.Errorf("%w: about %.0f pixels requested", OutputPixelsError, pixels)
+	}
+	return nil
+}
+
+// estimateOutputPixels returns the pixel count of the largest image built by libvips, computed like bimg does:
+// a missing dimension follows the aspect ratio, crops first resize the image to cover both dimensions,
+// and zoom multiplies the source size.
+func estimateOutputPixels(options imageOptions, metadata bimg.ImageMetadata) float64 {
+	width, height := float64(metadata.Size.Width), float64(metadata.Size.Height)
+	if metadata.Orientation >= 5 && !options.NoAutoRotate {
+		// Image will be rotated by 90 or 270 degrees
+		width, height = height, width
+	}
+	if width == 0 || height == 0 {
+		return 0
+	}
+
+	var zoomed float64
+	if options.Zoom > 0 {
+		zoom := float64(options.Zoom) + 1
+		zoomed = width * height * zoom * zoom
+	}
+
+	requestedWidth, requestedHeight := float64(options.Width), float64(options.Height)
+	output := width * height
+	switch {
+	case options.Width > 0 && options.Height > 0 && options.Crop:
+		scale := math.Max(requestedWidth/width, requestedHeight/height)
+		output = width * height * scale * scale
+	case options.Width > 0 && options.Height > 0:
+		output = requestedWidth * requestedHeight
+	case options.Width > 0 && options.Crop:
+		output = requestedWidth * height
+	case options.Width > 0:
+		output = requestedWidth * height * requestedWidth / width
+	case options.Height > 0 && options.Crop:
+		output = width * requestedHeight
+	case options.Height > 0:
+		output = requestedHeight * width * requestedHeight / height
+	}
+	return math.Max(zoomed, output)
+}
@@ -0,0 +1,28 @@
+package CADDY_FILE_SERVER
+
+import (
+	"github.com/h2non/bimg"
+	"testing"
+)
+
+func TestEstimateOutputPixels(t *testing.T) {
+	metadata := bimg.ImageMetadata{Size: bimg.ImageSize{Width: 1000, Height: 500}}
+
+	tests := []struct {
+		name    string
+		options imageOptions
+		want    float64
+	}{
+		{"source size", imageOptions{}, 500_000},
+		{"width only", imageOptions{Options: bimg.Options{Width: 60000}}, 60000 * 30000},
+		{"height only", imageOptions{Options: bimg.Options{Height: 1000}}, 2000 * 1000},
+		{"both dimensions", imageOptions{Options: bimg.Options{Width: 300, Height: 300}}, 300 * 300},
+		{"crop", imageOptions{Options: bimg.Options{Width: 4000, Height: 100, Crop: true}}, 4000 * 2000},
+		{"zoom", imageOptions{Options: bimg.Options{Width: 100, Zoom: 3}}, 1000 * 500 * 16},
+	}
+	for _, test := range tests {
+		if got := estimateOutputPixels(test.options, metadata); got != test.want {
+			t.Errorf("%s: estimateOutputPixels() = %.0f, want %.0f", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package CADDY_FILE_SERVER
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"sync"
+)
+
+// MemoryCacheOptions configure the in-memory cache of processed images.
+// It sits in front of the persistent cache and keeps hot variants until MaxSize bytes are used.
+type MemoryCacheOptions struct {
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type memoryCacheEntry struct {
+	key         string
+	contentType string
+	body        []byte
+}
+
+func (e *memoryCacheEntry) size() int64 {
+	return int64(len(e.contentType) + len(e.body))
+}
+
+// Provision initialize the LRU index
+func (c *MemoryCacheOptions) Provision(ctx caddy.Context) error {
+	c.lru = list.New()
+	c.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// Validate ensure memory cache parameters are correctly defined
+func (c *MemoryCacheOptions) Validate() error {
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("memory_cache 'max_size' must be greater than 0")
+	}
+	return nil
+}
+
+// Get returns the content type and body of a cached variant
+func (c *MemoryCacheOptions) Get(variantKey string) (string, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[variantKey]
+	if !exists {
+		stats.Add("memory_cache_misses", 1)
+		return "", nil, false
+	}
+
+	stats.Add("memory_cache_hits", 1)
+	c.lru.MoveToFront(element)
+	entry := element.Value.(*memoryCacheEntry)
+	return entry.contentType, entry.body, true
+}
+
+// Set stores a processed variant and evicts least recently used ones if the cache is full
+func (c *MemoryCacheOptions) Set(variantKey string, contentType string, body []byte) {
+	entry := &memoryCacheEntry{key: variantKey, contentType: contentType, body: body}
+	if entry.size() > c.MaxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[variantKey]; exists {
+		c.size -= c.lru.Remove(element).(*memoryCacheEntry).size()
+	}
+	c.entries[variantKey] = c.lru.PushFront(entry)
+	c.size += entry.size()
+
+	for c.size > c.MaxSize {
+		evicted := c.lru.Remove(c.lru.Back()).(*memoryCacheEntry)
+		delete(c.entries, evicted.key)
+		c.size -= evicted.size()
+	}
+}
+
+func (c *MemoryCacheOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	size, err := humanize.ParseBytes(d.Val())
+	if err != nil {
+		return d.Errf("invalid value for memory_cache: %v", err)
+	}
+	c.MaxSize = int64(size)
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
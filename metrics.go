@@ -0,0 +1,115 @@
+package CADDY_FILE_SERVER
+
+import (
+	"github.com/h2non/bimg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// Request outcomes, used as label values
+const (
+	outcomeProcessed          = "processed"
+	outcomeNotModified        = "not_modified"
+	outcomeErrorBypass        = "error_bypass"
+	outcomeErrorAbort         = "error_abort"
+	outcomeSecurityBypass     = "security_bypass"
+	outcomeSecurityAbort      = "security_abort"
+	outcomeQueueBypass        = "queue_bypass"
+	outcomeQueueReject        = "queue_reject"
+	outcomeInputFormatBypass  = "input_format_bypass"
+	outcomeInputFormatReject  = "input_format_reject"
+	outcomeInvalidParamBypass = "invalid_param_bypass"
+	outcomeInvalidParamAbort  = "invalid_param_abort"
+)
+
+// imageMetrics are registered in the default registry, exposed by Caddy on /metrics
+var imageMetrics = struct {
+	init               sync.Once
+	requests           *prometheus.CounterVec
+	processingDuration *prometheus.HistogramVec
+	inputSize          *prometheus.HistogramVec
+	outputSize         *prometheus.HistogramVec
+	cacheLookups       *prometheus.CounterVec
+	queueDepth         prometheus.Gauge
+	queueRejections    *prometheus.CounterVec
+}{
+	init: sync.Once{},
+}
+
+func initImageMetrics() {
+	const ns, sub = "caddy", "image_processor"
+
+	sizeBuckets := prometheus.ExponentialBuckets(1024, 4, 10)
+
+	imageMetrics.requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Counter of requests with processing parameters, by outcome.",
+	}, []string{"outcome"})
+	imageMetrics.processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "processing_duration_seconds",
+		Help:      "Histogram of libvips processing durations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"input_format", "output_format"})
+	imageMetrics.inputSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "input_size_bytes",
+		Help:      "Size of processed source images.",
+		Buckets:   sizeBuckets,
+	}, []string{"format"})
+	imageMetrics.outputSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "output_size_bytes",
+		Help:      "Size of processed images.",
+		Buckets:   sizeBuckets,
+	}, []string{"format"})
+	imageMetrics.cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_lookups_total",
+		Help:      "Counter of processed image cache lookups, by tier (memory, storage) and result (hit, miss).",
+	}, []string{"tier", "result"})
+	imageMetrics.queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "queue_depth",
+		Help:      "Number of jobs waiting for a processing slot.",
+	})
+	imageMetrics.queueRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "queue_rejections_total",
+		Help:      "Counter of jobs that did not get a processing slot, by reason (full, timeout).",
+	}, []string{"reason"})
+}
+
+// observeOutcome counts a request by its outcome
+func observeOutcome(outcome string) {
+	imageMetrics.requests.WithLabelValues(outcome).Inc()
+}
+
+// observeCacheLookup counts a cache lookup on the given tier
+func observeCacheLookup(tier string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	imageMetrics.cacheLookups.WithLabelValues(tier, result).Inc()
+}
+
+// observeProcessing records duration and sizes of a libvips job, formats are bounded to bimg known types
+func observeProcessing(start time.Time, input []byte, output []byte) {
+	inputFormat := bimg.DetermineImageTypeName(input)
+	outputFormat := bimg.DetermineImageTypeName(output)
+
+	imageMetrics.processingDuration.WithLabelValues(inputFormat, outputFormat).Observe(time.Since(start).Seconds())
+	imageMetrics.inputSize.WithLabelValues(inputFormat).Observe(float64(len(input)))
+	imageMetrics.outputSize.WithLabelValues(outputFormat).Observe(float64(len(output)))
+}
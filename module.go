@@ -3,19 +3,26 @@ package CADDY_FILE_SERVER
 import (
 	"bytes"
 	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/h2non/bimg"
+	"github.com/cespare/xxhash/v2"
+	"github.com/dustin/go-humanize"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zstd"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
@@ -35,12 +42,106 @@ const (
 	OnFailBypass OnFail = "bypass"
 )
 
+// OnInvalidParam represents the possible values for the "on_invalid_param" directive.
+type OnInvalidParam string
+
+const (
+	// OnInvalidParamIgnore processes the image with the valid parameters only.
+	OnInvalidParamIgnore OnInvalidParam = "ignore"
+
+	// OnInvalidParamBypass returns the initial (unprocessed) image.
+	OnInvalidParamBypass OnInvalidParam = "bypass"
+
+	// OnInvalidParamAbort returns a 400 Bad Request with the list of invalid parameters as JSON.
+	OnInvalidParamAbort OnInvalidParam = "abort"
+)
+
 // Middleware allow user to do image processing on the fly using libvips
 // With simple queries parameters you can resize, convert, crop your served images
 type Middleware struct {
 	logger   *zap.Logger
 	OnFail   OnFail           `json:"on_fail,omitempty"`
 	Security *SecurityOptions `json:"security,omitempty"`
+	Cache    *CacheOptions    `json:"cache,omitempty"`
+
+	MemoryCache *MemoryCacheOptions `json:"memory_cache,omitempty"`
+
+	// UseErrorHandlers returns security aborts as errors handled by handle_errors routes
+	UseErrorHandlers bool `json:"use_error_handlers,omitempty"`
+
+	// OnInvalidParam defines the response when parameter values cannot be parsed: ignore, bypass or abort
+	OnInvalidParam OnInvalidParam `json:"on_invalid_param,omitempty"`
+
+	// AutoFormat negotiates the output format from the Accept header when 'fm' is not provided
+	AutoFormat bool `json:"auto_format,omitempty"`
+
+	// Presets are named sets of parameters selected with 'p'
+	Presets Presets `json:"presets,omitempty"`
+
+	// PathPrefix enables parameters in path, like /<prefix>/w_400,h_300/image.jpg
+	PathPrefix string `json:"path_prefix,omitempty"`
+
+	// ClientHints fills 'dpr' and 'w' from Client Hints headers when not provided
+	ClientHints bool `json:"client_hints,omitempty"`
+
+	// Watermark composites an overlay image on processed images
+	Watermark *WatermarkOptions `json:"watermark,omitempty"`
+
+	// TextWatermark draws configured texts on processed images, selected with 'wmt'
+	TextWatermark *TextWatermarkOptions `json:"text_watermark,omitempty"`
+
+	// MaxConcurrent limits the number of simultaneous libvips jobs (unlimited if 0)
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// MaxQueue limits the number of jobs waiting for a slot when MaxConcurrent is reached
+	MaxQueue int `json:"max_queue,omitempty"`
+
+	// QueueTimeout limits the time a job waits for a slot (unlimited if 0)
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+
+	// OnQueueFull defines the response when no slot is available: bypass, reject or wait
+	OnQueueFull OnQueueFull `json:"on_queue_full,omitempty"`
+
+	// StripParams removes processing parameters from the url forwarded to the next handler.
+	// It applies to every request, so the handler must be scoped to image paths with a matcher.
+	StripParams bool `json:"strip_params,omitempty"`
+
+	// BufferTypes lists upstream media types buffered for processing, like image/png or image/* (default)
+	BufferTypes []string `json:"buffer_types,omitempty"`
+
+	// MaxBufferSize limits the size of buffered responses, larger ones are streamed (defaults to MaxInputBytes)
+	MaxBufferSize int64 `json:"max_buffer_size,omitempty"`
+
+	// InputFormats lists source formats allowed to be processed, like jpeg or png (all if empty)
+	InputFormats []string `json:"input_formats,omitempty"`
+
+	// OnInputFormat defines the response for disallowed source formats: bypass or reject
+	OnInputFormat OnInputFormat `json:"on_input_format,omitempty"`
+
+	// MaxInputBytes limits the size of source images, before and after decompression (unlimited if 0)
+	MaxInputBytes int64 `json:"max_input_bytes,omitempty"`
+
+	// MaxInputPixels limits the pixel count of source images, read from their header (unlimited if 0)
+	MaxInputPixels int64 `json:"max_input_pixels,omitempty"`
+
+	// MaxOutputPixels limits the pixel count of processed images (unlimited if 0)
+	MaxOutputPixels int64 `json:"max_output_pixels,omitempty"`
+
+	// Timeout bounds the processing time of a request, including the wait for a slot (unlimited if 0)
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// limiter bounds concurrent libvips jobs when MaxConcurrent is set
+	limiter *limiter
+
+	// processGroup collapses concurrent processing of the same variant into a single libvips job
+	processGroup singleflight.Group
+
+	// jobs tracks the requests waiting for each processing job, keyed by variant
+	jobsMu sync.Mutex
+	jobs   map[string]*processJob
+
+	// configFingerprint identifies the configuration changing processed images outside of parameters
+	configFingerprint string
 }
 
 func (*Middleware) CaddyModule() caddy.ModuleInfo {
@@ -52,14 +153,59 @@ func (*Middleware) CaddyModule() caddy.ModuleInfo {
 
 func (m *Middleware) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger()
+	imageMetrics.init.Do(initImageMetrics)
+	m.jobs = make(map[string]*processJob)
 
 	// Set default configuration
 	m.OnFail = cmp.Or(m.OnFail, OnFailBypass)
+	m.OnInvalidParam = cmp.Or(m.OnInvalidParam, OnInvalidParamBypass)
+	m.OnQueueFull = cmp.Or(m.OnQueueFull, OnQueueFullBypass)
+	m.OnInputFormat = cmp.Or(m.OnInputFormat, OnInputFormatBypass)
+	m.MaxBufferSize = cmp.Or(m.MaxBufferSize, m.MaxInputBytes)
+	if len(m.BufferTypes) == 0 {
+		m.BufferTypes = defaultBufferTypes
+	}
+	if m.MaxConcurrent > 0 {
+		m.limiter = newLimiter(m.MaxConcurrent, m.MaxQueue, time.Duration(m.QueueTimeout), m.OnQueueFull)
+	}
 	if m.Security != nil {
 		if err := m.Security.Provision(ctx); err != nil {
 			return err
 		}
 	}
+	if m.Cache != nil {
+		if err := m.Cache.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	if m.MemoryCache != nil {
+		if err := m.MemoryCache.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	if m.Watermark != nil {
+		if err := m.Watermark.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	if m.TextWatermark != nil {
+		if err := m.TextWatermark.Provision(ctx); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if m.configFingerprint, err = getConfigFingerprint(m.Watermark, m.TextWatermark); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Cleanup releases resources shared between configurations
+func (m *Middleware) Cleanup() error {
+	if m.Cache != nil {
+		return m.Cache.Cleanup()
+	}
 	return nil
 }
 
@@ -71,35 +217,122 @@ func (m *Middleware) Validate() error {
 		return fmt.Errorf("invalid value for on_fail: '%s' (expected 'abort', or 'bypass')", m.OnFail)
 	}
 
+	switch m.OnInvalidParam {
+	case OnInvalidParamIgnore, OnInvalidParamBypass, OnInvalidParamAbort:
+		// Valid values
+	default:
+		return fmt.Errorf("invalid value for on_invalid_param: '%s' (expected 'ignore', 'bypass' or 'abort')", m.OnInvalidParam)
+	}
+
+	switch m.OnQueueFull {
+	case OnQueueFullBypass, OnQueueFullReject, OnQueueFullWait:
+		// Valid values
+	default:
+		return fmt.Errorf("invalid value for on_queue_full: '%s' (expected 'bypass', 'reject' or 'wait')", m.OnQueueFull)
+	}
+
+	if m.MaxConcurrent < 0 || m.MaxQueue < 0 || m.QueueTimeout < 0 {
+		return fmt.Errorf("max_concurrent, max_queue and queue_timeout must be positive")
+	}
+
+	if m.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+
+	if m.MaxInputBytes < 0 || m.MaxInputPixels < 0 || m.MaxOutputPixels < 0 {
+		return fmt.Errorf("max_input_bytes, max_input_pixels and max_output_pixels must be positive")
+	}
+
+	if m.MaxBufferSize < 0 {
+		return fmt.Errorf("max_buffer_size must be positive")
+	}
+	if err := validateMediaTypePatterns(m.BufferTypes); err != nil {
+		return err
+	}
+
+	switch m.OnInputFormat {
+	case OnInputFormatBypass, OnInputFormatReject:
+		// Valid values
+	default:
+		return fmt.Errorf("invalid value for on_input_format: '%s' (expected 'bypass' or 'reject')", m.OnInputFormat)
+	}
+	if err := validateInputFormats(m.InputFormats); err != nil {
+		return err
+	}
+
+	if m.PathPrefix != "" && (!strings.HasPrefix(m.PathPrefix, "/") || m.PathPrefix == "/") {
+		return fmt.Errorf("invalid value for path_prefix: '%s' (expected a path like '/_img')", m.PathPrefix)
+	}
+
 	if m.Security != nil {
 		if err := m.Security.Validate(); err != nil {
 			return err
 		}
+		if m.Security.OnlyPresets && len(m.Presets) == 0 {
+			return fmt.Errorf("'only_presets' requires at least one preset")
+		}
+	}
+
+	if m.Presets != nil {
+		if err := m.Presets.Validate(m.Security); err != nil {
+			return err
+		}
+	}
+
+	if m.Cache != nil {
+		if err := m.Cache.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.MemoryCache != nil {
+		if err := m.MemoryCache.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Watermark != nil {
+		if err := m.Watermark.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.TextWatermark != nil {
+		if err := m.TextWatermark.Validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Extract parameters from path if used, the request is rewritten to the initial image path
+	pathForm := m.extractPathForm(r)
+
 	//Automatic return if not options set
-	if r.URL.RawQuery == "" {
+	if r.URL.RawQuery == "" && pathForm == nil {
 		return next.ServeHTTP(w, r)
 	}
 
-	responseRecorder := caddyhttp.NewResponseRecorder(w, &bytes.Buffer{}, func(status int, header http.Header) bool {
-		return true
-	})
+	responseRecorder := caddyhttp.NewResponseRecorder(w, &bytes.Buffer{}, m.shouldBuffer)
 
-	if err := next.ServeHTTP(responseRecorder, r); err != nil {
+	// Forward a canonical url to upstream if requested, parameters are read from the initial request
+	upstreamRequest := r
+	if m.StripParams {
+		upstreamRequest = getUpstreamRequest(r)
+	}
+
+	limitedRecorder := &limitedRecorder{ResponseRecorder: responseRecorder, w: w, limit: m.MaxBufferSize}
+	if err := next.ServeHTTP(limitedRecorder, upstreamRequest); err != nil {
 		return err
 	}
 
-	if responseRecorder.Status() != 200 || responseRecorder.Size() == 0 {
-		return responseRecorder.WriteResponse()
+	// Response was not an image to process or was too large, it has already been streamed to the client
+	if !responseRecorder.Buffered() || limitedRecorder.streamed {
+		return nil
 	}
 
-	decoded, err := m.getDecodedBufferFromResponse(&responseRecorder)
-	if err != nil {
-		m.logger.Error("error getting initial response", zap.Error(err))
+	if responseRecorder.Status() != 200 || responseRecorder.Size() == 0 {
 		return responseRecorder.WriteResponse()
 	}
 
@@ -108,6 +341,23 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 		return errors.Join(errors.New("failed to parse form"), err)
 	}
 
+	// Parameters in path take precedence over query ones
+	for param, values := range pathForm {
+		r.Form[param] = values
+	}
+
+	// Verify url signature before any parameter is trusted
+	if m.Security != nil {
+		if err := m.Security.ProcessRequestSignature(r.URL.Path, &r.Form); err != nil {
+			return m.handleSecurityError(w, r, err, responseRecorder)
+		}
+	}
+
+	// Replace preset by its parameters
+	if err := m.expandPreset(&r.Form); err != nil {
+		return m.handleSecurityError(w, r, err, responseRecorder)
+	}
+
 	// Remove unsupported query parameters
 	filterForm(&r.Form)
 
@@ -116,86 +366,344 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 		return responseRecorder.WriteResponse()
 	}
 
+	// Complete parameters with client hints, they are then checked like any other parameter.
+	// Signed urls and presets fully define the processing, so hints are ignored when they are enforced.
+	var vary []string
+	if m.ClientHints && (m.Security == nil || (m.Security.Signing == nil && !m.Security.OnlyPresets)) {
+		w.Header().Set("Accept-CH", acceptClientHints)
+		vary = append(vary, applyClientHints(r, &r.Form)...)
+	}
+
 	// Send to security middleware if defined
 	if m.Security != nil {
 		if err := m.Security.ProcessRequestForm(&r.Form); err != nil {
-			if errors.Is(err, BypassRequestError) {
-				return responseRecorder.WriteResponse()
-			}
+			return m.handleSecurityError(w, r, err, responseRecorder)
+		}
 
-			var abortRequestError *AbortRequestError
-			if errors.As(err, &abortRequestError) {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return nil
-			}
+		// Return initial image if no parameters remains
+		if len(r.Form) == 0 {
+			return responseRecorder.WriteResponse()
+		}
+	}
 
-			return err
+	// Resolve output format from the Accept header if requested
+	if m.negotiateFormat(r, &r.Form) {
+		vary = append(vary, "Accept")
+
+		// Initial image is kept for this client, but other clients may receive another format
+		if len(r.Form) == 0 {
+			for _, value := range vary {
+				w.Header().Add("Vary", value)
+			}
+			return responseRecorder.WriteResponse()
 		}
+	}
 
-		// Return initial image if no parameters remains
+	// Parse options, invalid parameters are handled according to on_invalid_param
+	options, err := m.parseOptions(&r.Form)
+	var invalidParamsError *InvalidParamsError
+	if errors.As(err, &invalidParamsError) && m.OnInvalidParam == OnInvalidParamIgnore {
+		for _, invalidParam := range invalidParamsError.Params {
+			r.Form.Del(invalidParam.Param)
+		}
+		// Initial image keeps its own Vary values, like Accept-Encoding
 		if len(r.Form) == 0 {
+			for _, value := range vary {
+				w.Header().Add("Vary", value)
+			}
 			return responseRecorder.WriteResponse()
 		}
+		options, err = m.parseOptions(&r.Form)
+	}
+	if err != nil {
+		m.logger.Debug("invalid parameters", zap.Error(err))
+		return m.handleInvalidParams(w, err, responseRecorder)
 	}
 
-	// Generate specific ETag if necessary
-	processedEtag := getProcessedImageEtag(responseRecorder.Header().Get("ETag"), &r.Form)
-	if processedEtag != "" {
-		responseRecorder.Header().Del("ETag") // Remove initial ETag
-		w.Header().Set("ETag", processedEtag)
+	// Read the source image, once there is something to process
+	decoded, err := m.getDecodedBufferFromResponse(&responseRecorder)
+	if errors.Is(err, InputTooLargeError) {
+		m.logger.Warn("input image rejected", zap.Error(err))
+		return m.handleFailure(w, err, responseRecorder)
+	}
+	if err != nil {
+		m.logger.Error("error getting initial response", zap.Error(err))
+		return responseRecorder.WriteResponse()
+	}
+
+	// Only decode allowed formats
+	if err := m.checkInputFormat(decoded); err != nil {
+		m.logger.Debug("input image format not allowed", zap.Error(err))
+		return m.handleInputFormatError(w, err, responseRecorder)
+	}
 
+	// Generate specific ETag if necessary, it replaces the initial one only when the processed image is served
+	initialEtag := responseRecorder.Header().Get("ETag")
+	processedEtag := getProcessedImageEtag(initialEtag, &r.Form, m.configFingerprint)
+	if processedEtag != "" {
 		// Check If-None-Match header to avoid reprocessing
 		ifNoneMatchHeader := r.Header.Get("If-None-Match")
 		if ifNoneMatchHeader != "" && ifNoneMatchHeader == processedEtag {
+			w.Header().Set("ETag", processedEtag)
+			setVaryHeader(w.Header(), vary)
+			observeOutcome(outcomeNotModified)
 			w.WriteHeader(http.StatusNotModified)
 			return nil
 		}
 	}
 
-	// Parse options
-	options, err := getOptions(&r.Form)
+	// Serve previously processed image from caches, sources without ETag are identified by their content
+	sourceVersion := initialEtag
+	if sourceVersion == "" {
+		sourceVersion = fmt.Sprintf("xxh-%x", xxhash.Sum64(decoded))
+	}
+	variantKey := getVariantKey(r, sourceVersion, &r.Form, m.configFingerprint)
+	if contentType, cachedImage, ok := m.getCachedVariant(r.Context(), variantKey); ok {
+		observeOutcome(outcomeProcessed)
+		return m.writeImage(w, contentType, cachedImage, processedEtag, vary)
+	}
+
+	// Bound processing time, the client disconnection also stops waiting
+	ctx := r.Context()
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(m.Timeout))
+		defer cancel()
+	}
+
+	contentType, newImage, err := m.processImage(ctx, variantKey, decoded, options)
+	if errors.Is(err, QueueFullError) || (errors.Is(err, QueueTimeoutError) && m.OnQueueFull != OnQueueFullWait) {
+		return m.handleQueueFull(w, responseRecorder)
+	}
+	if errors.Is(err, context.Canceled) {
+		m.logger.Debug("client disconnected before processing ended", zap.Error(err))
+		return nil
+	}
 	if err != nil {
-		m.logger.Error("error parsing options", zap.Error(err))
+		m.logger.Error("error processing image", zap.Error(err))
+		return m.handleFailure(w, err, responseRecorder)
+	}
+
+	if err = m.writeImage(w, contentType, newImage, processedEtag, vary); err != nil {
+		m.logger.Error("error writing processed image", zap.Error(err))
+		return m.handleFailure(w, err, responseRecorder)
+	}
+
+	observeOutcome(outcomeProcessed)
+	return nil
+}
+
+// handleFailure serves the initial image or aborts the request depending on on_fail
+func (m *Middleware) handleFailure(w http.ResponseWriter, err error, responseRecorder caddyhttp.ResponseRecorder) error {
+	if m.OnFail == OnFailBypass {
+		observeOutcome(outcomeErrorBypass)
+		return responseRecorder.WriteResponse()
+	}
+	if m.OnFail == OnFailAbort {
+		observeOutcome(outcomeErrorAbort)
+		removeInitialHeaders(w.Header())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	return err
+}
+
+// handleInvalidParams serves the initial image or aborts the request with the list of invalid parameters
+func (m *Middleware) handleInvalidParams(w http.ResponseWriter, err error, responseRecorder caddyhttp.ResponseRecorder) error {
+	var invalidParamsError *InvalidParamsError
+	if m.OnInvalidParam != OnInvalidParamAbort || !errors.As(err, &invalidParamsError) {
+		observeOutcome(outcomeInvalidParamBypass)
 		return responseRecorder.WriteResponse()
 	}
 
-	newImage, err := bimg.NewImage(decoded).Process(options)
+	observeOutcome(outcomeInvalidParamAbort)
+	return writeJSON(w, http.StatusBadRequest, invalidParamsError)
+}
+
+// handleSecurityError serves the initial image or aborts the request depending on the security error
+func (m *Middleware) handleSecurityError(w http.ResponseWriter, r *http.Request, err error, responseRecorder caddyhttp.ResponseRecorder) error {
+	if errors.Is(err, BypassRequestError) {
+		observeOutcome(outcomeSecurityBypass)
+		return responseRecorder.WriteResponse()
+	}
+
+	var abortRequestError *AbortRequestError
+	if errors.As(err, &abortRequestError) {
+		observeOutcome(outcomeSecurityAbort)
+		status := cmp.Or(abortRequestError.Status, http.StatusBadRequest)
+		removeInitialHeaders(w.Header())
+
+		// Let handle_errors routes write the response
+		if m.UseErrorHandlers {
+			return caddyhttp.Error(status, err)
+		}
+		return writeAbortResponse(w, r, status, abortRequestError)
+	}
+
+	return err
+}
+
+// writeAbortResponse writes the abort reason as JSON if accepted by the client, as plain text otherwise
+func writeAbortResponse(w http.ResponseWriter, r *http.Request, status int, abortRequestError *AbortRequestError) error {
+	if _, ok := getAcceptedMediaTypes(r.Header.Get("Accept"))["application/json"]; !ok {
+		http.Error(w, abortRequestError.Error(), status)
+		return nil
+	}
+
+	return writeJSON(w, status, abortRequestError)
+}
+
+// writeJSON writes an error response as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	body, err := json.Marshal(v)
 	if err != nil {
-		m.logger.Error("error processing image", zap.Error(err))
-		if m.OnFail == OnFailBypass {
-			return responseRecorder.WriteResponse()
+		return err
+	}
+	removeInitialHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	return err
+}
+
+// removeInitialHeaders removes the headers describing the initial image, which the recorder shares
+// with the client response, before another body is written
+func removeInitialHeaders(header http.Header) {
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Del("ETag")
+	header.Del("Last-Modified")
+}
+
+// getCachedVariant looks up a processed image in the memory cache, then in the persistent cache
+func (m *Middleware) getCachedVariant(ctx context.Context, variantKey string) (string, []byte, bool) {
+	if m.MemoryCache != nil {
+		contentType, image, ok := m.MemoryCache.Get(variantKey)
+		observeCacheLookup("memory", ok)
+		if ok {
+			return contentType, image, true
 		}
-		if m.OnFail == OnFailAbort {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
+	}
+
+	if m.Cache != nil {
+		contentType, image, ok := m.Cache.Get(ctx, variantKey)
+		observeCacheLookup("storage", ok)
+		if ok {
+			if m.MemoryCache != nil {
+				m.MemoryCache.Set(variantKey, contentType, image)
+			}
+			return contentType, image, true
 		}
-		return err
+	}
+	return "", nil, false
+}
+
+// processedVariant is the result shared between coalesced requests
+type processedVariant struct {
+	contentType string
+	body        []byte
+}
 
+// processJob is a processing job shared by coalesced requests
+type processJob struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// joinJob returns the job processing the variant, a new one is created if no request waits for it
+func (m *Middleware) joinJob(variantKey string) *processJob {
+	m.jobsMu.Lock()
+	defer m.jobsMu.Unlock()
+
+	job, exists := m.jobs[variantKey]
+	if !exists {
+		job = &processJob{}
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		m.jobs[variantKey] = job
 	}
+	job.waiters++
+	return job
+}
+
+// leaveJob stops waiting for the job, it is cancelled once no request waits for it anymore
+func (m *Middleware) leaveJob(variantKey string, job *processJob) {
+	m.jobsMu.Lock()
+	defer m.jobsMu.Unlock()
 
+	job.waiters--
+	if job.waiters > 0 {
+		return
+	}
+	delete(m.jobs, variantKey)
+
+	// Later requests start a new job instead of sharing the cancelled one
+	m.processGroup.Forget(variantKey)
+	job.cancel()
+}
+
+// processImage runs libvips on the decoded image and stores the result in caches.
+// Concurrent requests for the same variant wait for a single processing job, bounded by the timeout.
+// The job is cancelled once every request waiting for it is gone, a running libvips job still finishes.
+func (m *Middleware) processImage(ctx context.Context, variantKey string, decoded []byte, options imageOptions) (string, []byte, error) {
+	job := m.joinJob(variantKey)
+	defer m.leaveJob(variantKey, job)
+
+	resultChan := m.processGroup.DoChan(variantKey, func() (interface{}, error) {
+		jobCtx := job.ctx
+		if m.Timeout > 0 {
+			var cancel context.CancelFunc
+			jobCtx, cancel = context.WithTimeout(jobCtx, time.Duration(m.Timeout))
+			defer cancel()
+		}
+
+		contentType, newImage, err := m.process(jobCtx, decoded, options)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.MemoryCache != nil {
+			m.MemoryCache.Set(variantKey, contentType, newImage)
+		}
+		if m.Cache != nil {
+			go m.Cache.Set(context.Background(), variantKey, contentType, newImage)
+		}
+		return processedVariant{contentType, newImage}, nil
+	})
+
+	select {
+	case result := <-resultChan:
+		if result.Shared {
+			stats.Add("coalesced_requests", 1)
+		}
+		if result.Err != nil {
+			return "", nil, result.Err
+		}
+		variant := result.Val.(processedVariant)
+		return variant.contentType, variant.body, nil
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+// writeImage replaces proxied headers and writes the processed image to the client
+func (m *Middleware) writeImage(w http.ResponseWriter, contentType string, image []byte, etag string, vary []string) error {
 	// Remove proxied invalid header
 	w.Header().Del("Content-Type")
 	w.Header().Del("Content-Length")
 	w.Header().Del("Content-Encoding")
-	w.Header().Del("Vary")
+	setVaryHeader(w.Header(), vary)
 
 	// Set new headers
-	w.Header().Set("Content-Length", strconv.Itoa(len(newImage)))
-	w.Header().Set("Content-Type", "image/"+bimg.DetermineImageTypeName(newImage))
-
-	if _, err = w.Write(newImage); err != nil {
-		m.logger.Error("error writing processed image", zap.Error(err))
-		if m.OnFail == OnFailBypass {
-			return responseRecorder.WriteResponse()
-		}
-		if m.OnFail == OnFailAbort {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
-		}
-		return err
+	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+	w.Header().Set("Content-Type", contentType)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
 	}
 
-	return nil
+	_, err := w.Write(image)
+	return err
 }
 
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -214,6 +722,17 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr() // More than one argument provided
 				}
 
+				break
+			case "on_invalid_param":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnInvalidParam = OnInvalidParam(d.Val())
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 				break
 			case "security":
 				m.Security = &SecurityOptions{}
@@ -221,6 +740,195 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return err
 				}
 				break
+			case "use_error_handlers":
+				m.UseErrorHandlers = true
+
+				// Ensure there are no arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "auto_format":
+				m.AutoFormat = true
+
+				// Ensure there are no arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "presets":
+				if m.Presets == nil {
+					m.Presets = Presets{}
+				}
+				if err := m.Presets.UnmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				break
+			case "path_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PathPrefix = d.Val()
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "max_concurrent", "max_queue":
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				value, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid value for %s: %v", option, err)
+				}
+				if option == "max_concurrent" {
+					m.MaxConcurrent = value
+				} else {
+					m.MaxQueue = value
+				}
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "queue_timeout", "timeout":
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid value for %s: %v", option, err)
+				}
+				if option == "timeout" {
+					m.Timeout = caddy.Duration(timeout)
+				} else {
+					m.QueueTimeout = caddy.Duration(timeout)
+				}
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "buffer_types":
+				m.BufferTypes = d.RemainingArgs()
+				if len(m.BufferTypes) == 0 {
+					return d.ArgErr()
+				}
+				break
+			case "input_formats":
+				m.InputFormats = d.RemainingArgs()
+				if len(m.InputFormats) == 0 {
+					return d.ArgErr()
+				}
+				break
+			case "on_input_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnInputFormat = OnInputFormat(d.Val())
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "max_input_bytes", "max_buffer_size":
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid value for %s: %v", option, err)
+				}
+				if option == "max_input_bytes" {
+					m.MaxInputBytes = int64(size)
+				} else {
+					m.MaxBufferSize = int64(size)
+				}
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "max_input_pixels", "max_output_pixels":
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				pixels, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("invalid value for %s: %v", option, err)
+				}
+				if option == "max_input_pixels" {
+					m.MaxInputPixels = pixels
+				} else {
+					m.MaxOutputPixels = pixels
+				}
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "on_queue_full":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnQueueFull = OnQueueFull(d.Val())
+
+				// Ensure there are no more arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "strip_params":
+				m.StripParams = true
+
+				// Ensure there are no arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "client_hints":
+				m.ClientHints = true
+
+				// Ensure there are no arguments
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				break
+			case "cache":
+				m.Cache = &CacheOptions{}
+				if err := m.Cache.UnmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				break
+			case "memory_cache":
+				m.MemoryCache = &MemoryCacheOptions{}
+				if err := m.MemoryCache.UnmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				break
+			case "watermark":
+				m.Watermark = &WatermarkOptions{}
+				if err := m.Watermark.UnmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				break
+			case "text_watermark":
+				m.TextWatermark = &TextWatermarkOptions{}
+				if err := m.TextWatermark.UnmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				break
 
 			default:
 				return d.Errf("unexpected directive '%s' in image_processor block", d.Val())
@@ -230,7 +938,12 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// getDecodedBufferFromResponse decompresses the recorded body without consuming the recorder buffer,
+// which is still written as is when the initial image is served
 func (m *Middleware) getDecodedBufferFromResponse(r *caddyhttp.ResponseRecorder) ([]byte, error) {
+	if m.MaxInputBytes > 0 && int64((*r).Size()) > m.MaxInputBytes {
+		return nil, fmt.Errorf("%w: %d bytes received", InputTooLargeError, (*r).Size())
+	}
 
 	encoding := (*r).Header().Get("Content-Encoding")
 	if encoding == "" {
@@ -238,7 +951,7 @@ func (m *Middleware) getDecodedBufferFromResponse(r *caddyhttp.ResponseRecorder)
 	}
 
 	if encoding == "gzip" {
-		decoder, err := gzip.NewReader((*r).Buffer())
+		decoder, err := gzip.NewReader(bytes.NewReader((*r).Buffer().Bytes()))
 		if err != nil {
 			return nil, err
 		}
@@ -249,33 +962,39 @@ func (m *Middleware) getDecodedBufferFromResponse(r *caddyhttp.ResponseRecorder)
 			}
 		}(decoder)
 
-		decodedOut := bytes.Buffer{}
-		_, err = io.Copy(&decodedOut, decoder)
-		if err != nil {
-			return nil, err
-		}
-		return decodedOut.Bytes(), nil
+		return m.readDecompressed(decoder)
 	}
 
 	if encoding == "zstd" {
 		// Try decode zstd
-		var decoder, err = zstd.NewReader((*r).Buffer(), zstd.WithDecoderConcurrency(0))
+		var decoder, err = zstd.NewReader(bytes.NewReader((*r).Buffer().Bytes()), zstd.WithDecoderConcurrency(0))
 		if err != nil {
 			return nil, err
 		}
 		defer decoder.Close()
-		decodedOut := bytes.Buffer{}
-		_, err = io.Copy(&decodedOut, decoder)
-		if err != nil {
-			return nil, err
-		}
-		return decodedOut.Bytes(), nil
+		return m.readDecompressed(decoder)
 	}
 
 	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
 
 }
 
+// readDecompressed reads a decompressed body, stopping as soon as max_input_bytes is exceeded
+func (m *Middleware) readDecompressed(decoder io.Reader) ([]byte, error) {
+	if m.MaxInputBytes > 0 {
+		decoder = io.LimitReader(decoder, m.MaxInputBytes+1)
+	}
+
+	decodedOut := bytes.Buffer{}
+	if _, err := io.Copy(&decodedOut, decoder); err != nil {
+		return nil, err
+	}
+	if m.MaxInputBytes > 0 && int64(decodedOut.Len()) > m.MaxInputBytes {
+		return nil, fmt.Errorf("%w: decompressed body exceeds %d bytes", InputTooLargeError, m.MaxInputBytes)
+	}
+	return decodedOut.Bytes(), nil
+}
+
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m Middleware
 	err := m.UnmarshalCaddyfile(h.Dispenser)
@@ -286,6 +1005,7 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
 )
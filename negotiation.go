@@ -0,0 +1,68 @@
+package CADDY_FILE_SERVER
+
+import (
+	"github.com/h2non/bimg"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// negotiatedFormats lists output formats that can be selected from the Accept header, by order of preference.
+var negotiatedFormats = []struct {
+	param     string
+	mediaType string
+	imageType bimg.ImageType
+}{
+	{"avif", "image/avif", bimg.AVIF},
+	{"webp", "image/webp", bimg.WEBP},
+}
+
+// negotiateFormat replaces 'fm=auto' (or a missing 'fm' when auto_format is enabled)
+// with the best format accepted by the client, or removes it to keep the original format.
+// It returns true when the response depends on the Accept header.
+func (m *Middleware) negotiateFormat(r *http.Request, form *url.Values) bool {
+	format := form.Get("fm")
+	if format != "auto" && (format != "" || !m.AutoFormat) {
+		return false
+	}
+
+	accepted := getAcceptedMediaTypes(r.Header.Get("Accept"))
+	for _, candidate := range negotiatedFormats {
+		if _, ok := accepted[candidate.mediaType]; ok && bimg.IsTypeSupportedSave(candidate.imageType) {
+			form.Set("fm", candidate.param)
+			return true
+		}
+	}
+
+	form.Del("fm")
+	return true
+}
+
+// getAcceptedMediaTypes parses an Accept header, ignoring media ranges explicitly refused with q=0.
+func getAcceptedMediaTypes(header string) map[string]struct{} {
+	accepted := make(map[string]struct{})
+	for _, mediaRange := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+
+		refused := false
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q <= 0 {
+				refused = true
+			}
+		}
+
+		if !refused {
+			accepted[mediaType] = struct{}{}
+		}
+	}
+	return accepted
+}
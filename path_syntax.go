@@ -0,0 +1,39 @@
+package CADDY_FILE_SERVER
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// extractPathForm parses parameters from urls like /<prefix>/w_400,h_300,fm_webp/path/to/image.jpg
+// and rewrites the request path to /path/to/image.jpg.
+// It returns nil if the path syntax is disabled or the request does not use it.
+func (m *Middleware) extractPathForm(r *http.Request) url.Values {
+	if m.PathPrefix == "" {
+		return nil
+	}
+
+	remaining, found := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(m.PathPrefix, "/")+"/")
+	if !found {
+		return nil
+	}
+
+	segment, imagePath, found := strings.Cut(remaining, "/")
+	if !found || segment == "" || imagePath == "" {
+		return nil
+	}
+
+	form := url.Values{}
+	for _, option := range strings.Split(segment, ",") {
+		param, value, found := strings.Cut(option, "_")
+		if !found || param == "" {
+			return nil
+		}
+		form.Set(param, value)
+	}
+
+	r.URL.Path = "/" + imagePath
+	r.URL.RawPath = ""
+	return form
+}
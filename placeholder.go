@@ -0,0 +1,94 @@
+package CADDY_FILE_SERVER
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"github.com/h2non/bimg"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// Placeholder represents low-quality image placeholder outputs selected with 'fm'
+type Placeholder string
+
+const (
+	// PlaceholderBlurHash returns the BlurHash string of the image.
+	PlaceholderBlurHash Placeholder = "blurhash"
+
+	// PlaceholderThumbHash returns the base64 ThumbHash of the image.
+	PlaceholderThumbHash Placeholder = "thumbhash"
+
+	// PlaceholderLQIP returns a tiny image as a base64 data URI.
+	PlaceholderLQIP Placeholder = "lqip"
+)
+
+// placeholderSizes are the largest side of the image downscaled by libvips before encoding
+var placeholderSizes = map[Placeholder]int{
+	PlaceholderBlurHash:  32,
+	PlaceholderThumbHash: 100,
+	PlaceholderLQIP:      16,
+}
+
+// renderPlaceholder downscales the image, applying other parameters like crop or fit, and encodes the placeholder
+func (m *Middleware) renderPlaceholder(decoded []byte, options imageOptions) (string, []byte, error) {
+	options.applyPlaceholderSize(placeholderSizes[options.Placeholder])
+	options.Type = bimg.PNG
+
+	downscaled, err := m.transform(decoded, options)
+	if err != nil {
+		return "", nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(downscaled))
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch options.Placeholder {
+	case PlaceholderBlurHash:
+		return "text/plain; charset=utf-8", []byte(encodeBlurHash(img, options.BlurHashX, options.BlurHashY)), nil
+	case PlaceholderThumbHash:
+		return "text/plain; charset=utf-8", []byte(base64.StdEncoding.EncodeToString(encodeThumbHash(img))), nil
+	case PlaceholderLQIP:
+		dataURI, err := encodeDataURI(img, options.Quality)
+		return "text/plain; charset=utf-8", dataURI, err
+	}
+	return "", nil, fmt.Errorf("unknown placeholder '%s'", options.Placeholder)
+}
+
+// applyPlaceholderSize scales requested dimensions down so the largest side fits in size
+func (o *imageOptions) applyPlaceholderSize(size int) {
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		scale := float64(size) / float64(max(o.Width, o.Height))
+		o.Width = max(1, int(math.Round(float64(o.Width)*scale)))
+		o.Height = max(1, int(math.Round(float64(o.Height)*scale)))
+	case o.Width > 0:
+		o.Width = size
+	case o.Height > 0:
+		o.Height = size
+	default:
+		o.Width, o.Height = size, size
+		o.Fit = FitInside
+	}
+}
+
+// encodeDataURI encodes the image as JPEG, or PNG if it has transparency
+func encodeDataURI(img image.Image, quality int) ([]byte, error) {
+	buf := bytes.Buffer{}
+	mediaType := "image/png"
+
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		mediaType = "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: cmp.Or(quality, 70)}); err != nil {
+			return nil, err
+		}
+	} else if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return []byte("data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
@@ -0,0 +1,106 @@
+package CADDY_FILE_SERVER
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// presetParam selects a named preset defined in configuration
+const presetParam = "p"
+
+// Presets maps preset names to processing parameters, like {"card": {"w": "640", "fm": "webp"}}
+type Presets map[string]map[string]string
+
+// Validate ensure every preset only contains known parameters with valid values,
+// also satisfying security constraints if defined.
+func (ps *Presets) Validate(security *SecurityOptions) error {
+	for name, params := range *ps {
+		if len(params) == 0 {
+			return fmt.Errorf("preset '%s' must define at least one parameter", name)
+		}
+
+		form := url.Values{}
+		for param, value := range params {
+			if !slices.Contains(availableParams, param) {
+				return fmt.Errorf("unknown parameter '%s' in preset '%s'", param, name)
+			}
+			form.Set(param, value)
+		}
+
+		if _, err := getOptions(&form); err != nil {
+			return fmt.Errorf("invalid value in preset '%s': %v", name, err)
+		}
+
+		if security == nil || security.Constraints == nil {
+			continue
+		}
+		for param, value := range params {
+			for _, constraint := range (*security.Constraints)[param] {
+				if err := constraint.ValidateParam(param, value); err != nil {
+					return fmt.Errorf("preset '%s' does not satisfy %s constraint: %v", name, constraint.ID(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expandPreset replaces the 'p' parameter by the parameters of the selected preset.
+// Parameters explicitly present in the request take precedence over the preset ones.
+func (m *Middleware) expandPreset(form *url.Values) error {
+	if m.Security != nil && m.Security.OnlyPresets {
+		if err := m.Security.ProcessRawParams(form); err != nil {
+			return err
+		}
+	}
+
+	if !form.Has(presetParam) {
+		return nil
+	}
+
+	name := form.Get(presetParam)
+	form.Del(presetParam)
+
+	preset, exists := m.Presets[name]
+	if !exists {
+		if m.Security != nil {
+			return m.Security.fail(fmt.Sprintf("preset '%s' does not exist", name))
+		}
+		return nil
+	}
+
+	for param, value := range preset {
+		if !form.Has(param) {
+			form.Set(param, value)
+		}
+	}
+	return nil
+}
+
+func (ps *Presets) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if _, exists := (*ps)[name]; exists {
+			return d.Errf("duplicate preset '%s'", name)
+		}
+
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.Errf("preset '%s' requires at least one <param>=<value> argument", name)
+		}
+
+		params := make(map[string]string, len(args))
+		for _, arg := range args {
+			param, value, found := strings.Cut(arg, "=")
+			if !found {
+				return d.Errf("invalid argument '%s' in preset '%s', expected <param>=<value>", arg, name)
+			}
+			params[param] = value
+		}
+		(*ps)[name] = params
+	}
+	return nil
+}
@@ -1,15 +1,45 @@
 package CADDY_FILE_SERVER
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/h2non/bimg"
 	"net/url"
+	"slices"
 	"strconv"
+	"time"
 )
 
 var availableParams = []string{
 	"h", "w", "ah", "aw", "t", "l", "q", "cp", "z", "crop", "en", "em", "flip", "flop", "force",
-	"nar", "np", "itl", "smd", "tr", "ll", "th", "g", "br", "c", "r", "b", "bg", "fm",
+	"nar", "np", "itl", "smd", "tr", "ll", "th", "g", "br", "c", "r", "b", "bg", "fm", "fit", "pos", "gr",
+	"fpx", "fpy", "dpr", "wm", "wmt", "info", "bhx", "bhy",
+}
+
+// imageOptions completes bimg options with parameters that are resolved once the image is decoded
+type imageOptions struct {
+	bimg.Options
+	Fit Fit
+
+	// FocalPoint is set when both FocalX and FocalY (relative coordinates from 0 to 1) are provided
+	FocalPoint bool
+	FocalX     float64
+	FocalY     float64
+
+	// ApplyWatermark requests the configured watermark when its mode is 'param'
+	ApplyWatermark bool
+
+	// WatermarkText selects a text watermark by name
+	WatermarkText string
+
+	// Info requests the image metadata as JSON instead of the image
+	Info bool
+
+	// Placeholder replaces the image by a BlurHash, ThumbHash or LQIP when set from 'fm'
+	Placeholder Placeholder
+	BlurHashX   int
+	BlurHashY   int
 }
 
 // filterForm filters the given form in-place, keeping only the parameters that are in availableParams.
@@ -26,12 +56,32 @@ func filterForm(form *url.Values) {
 	}
 }
 
-func getOptions(form *url.Values) (bimg.Options, error) {
-	options := bimg.Options{
-		Interlace:     true,
-		StripMetadata: true,
+// hasProcessingParams returns true if the form contains a processing parameter or a preset
+func hasProcessingParams(form url.Values) bool {
+	for param := range form {
+		if param == presetParam || slices.Contains(availableParams, param) {
+			return true
+		}
+	}
+	return false
+}
+
+func getOptions(form *url.Values) (imageOptions, error) {
+	options := imageOptions{
+		Options: bimg.Options{
+			Interlace:     true,
+			StripMetadata: true,
+		},
+		BlurHashX: 4,
+		BlurHashY: 3,
 	}
 
+	// 'pos' is a sharp alias of 'gr', used only if 'gr' is not provided
+	var position bimg.Gravity
+
+	// 'dpr' multiplies 'w' and 'h'
+	var dpr float64
+
 	type CustomProcessor struct {
 		Func func(value string) error
 	}
@@ -65,8 +115,20 @@ func getOptions(form *url.Values) (bimg.Options, error) {
 		"b":     &options.GaussianBlur.Sigma, // int
 		"bg":    &options.Background,         // bimg.Color
 		"fm":    &options.Type,               // bimg.ID
+		"fit":   &options.Fit,                // Fit
+		"gr":    &options.Gravity,            // bimg.Gravity
+		"pos":   &position,                   // bimg.Gravity
+		"fpx":   &options.FocalX,             // float64
+		"fpy":   &options.FocalY,             // float64
+		"dpr":   &dpr,                        // float64
+		"wm":    &options.ApplyWatermark,     // bool
+		"wmt":   &options.WatermarkText,      // string
+		"info":  &options.Info,               // bool
+		"bhx":   &options.BlurHashX,          // int
+		"bhy":   &options.BlurHashY,          // int
 	}
 
+	invalidParams := &InvalidParamsError{}
 	for param, _ := range *form {
 		value := form.Get(param)
 		if value == "" {
@@ -77,25 +139,33 @@ func getOptions(form *url.Values) (bimg.Options, error) {
 			continue
 		}
 
-		var err error
 		switch dest.(type) {
 		case *int:
 			dest := dest.(*int)
-			if *dest, err = strconv.Atoi(value); err != nil {
-				return options, err
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				invalidParams.add(param, InvalidParamCodeInteger, fmt.Sprintf("'%s' must be an integer", param))
+				break
 			}
+			*dest = parsed
 
 		case *bool:
 			dest := dest.(*bool)
-			if *dest, err = strconv.ParseBool(value); err != nil {
-				return options, err
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				invalidParams.add(param, InvalidParamCodeBoolean, fmt.Sprintf("'%s' must be a boolean", param))
+				break
 			}
+			*dest = parsed
 
 		case *float64:
 			dest := dest.(*float64)
-			if *dest, err = strconv.ParseFloat(value, 64); err != nil {
-				return options, err
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				invalidParams.add(param, InvalidParamCodeFloat, fmt.Sprintf("'%s' must be a number", param))
+				break
 			}
+			*dest = parsed
 
 		case *string:
 			dest := dest.(*string)
@@ -103,60 +173,26 @@ func getOptions(form *url.Values) (bimg.Options, error) {
 
 		case *bimg.Color:
 			dest := dest.(*bimg.Color)
-
-			if value == "white" {
-				*dest = bimg.Color{255, 255, 255}
-				break
-			}
-			if value == "black" {
-				*dest = bimg.Color{0, 0, 0}
-				break
-			}
-			if value == "red" {
-				*dest = bimg.Color{255, 0, 0}
-				break
-			}
-			if value == "magenta" {
-				*dest = bimg.Color{255, 0, 255}
-				break
-			}
-			if value == "blue" {
-				*dest = bimg.Color{0, 0, 255}
-				break
-			}
-			if value == "cyan" {
-				*dest = bimg.Color{0, 255, 255}
-				break
-			}
-			if value == "green" {
-				*dest = bimg.Color{0, 255, 0}
-				break
-			}
-			if value == "yellow" {
-				*dest = bimg.Color{255, 255, 0}
-				break
-			}
-
-			c := bimg.Color{}
-			_, err := fmt.Sscanf(value, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+			color, err := parseColor(value)
 			if err != nil {
-				return options, fmt.Errorf("possible values for '%s' are white,black,red,magenta,blue,cyan,green,yellow or #xxxxx hex string", param)
+				invalidParams.add(param, InvalidParamCodeValue, fmt.Sprintf("possible values for '%s' are white,black,red,magenta,blue,cyan,green,yellow or #xxxxx hex string", param))
+				break
 			}
-
-			*dest = c
+			*dest = color
 
 		case *bimg.Angle:
 			dest := dest.(*bimg.Angle)
 			angle, err := strconv.Atoi(value)
 			if err != nil {
-				return options, err
+				invalidParams.add(param, InvalidParamCodeInteger, fmt.Sprintf("'%s' must be an integer", param))
+				break
 			}
 
 			switch angle {
 			case 45, 90, 135, 180, 235, 270, 315:
 				*dest = bimg.Angle(angle)
 			default:
-				return options, fmt.Errorf("possible values for '%s' are 45, 90, 135, 180, 235, 270, 315", param)
+				invalidParams.add(param, InvalidParamCodeValue, fmt.Sprintf("possible values for '%s' are 45, 90, 135, 180, 235, 270, 315", param))
 			}
 
 		case *bimg.ImageType:
@@ -172,10 +208,208 @@ func getOptions(form *url.Values) (bimg.Options, error) {
 				*dest = bimg.WEBP
 			case "avif":
 				*dest = bimg.AVIF
+			case "blurhash", "thumbhash", "lqip":
+				options.Placeholder = Placeholder(value)
 			default:
-				return options, fmt.Errorf("possible values for '%s' are jpg, jpeg, png, gif, webp, avif", param)
+				invalidParams.add(param, InvalidParamCodeValue, fmt.Sprintf("possible values for '%s' are jpg, jpeg, png, gif, webp, avif, blurhash, thumbhash, lqip", param))
 			}
+
+		case *Fit:
+			dest := dest.(*Fit)
+			fit, err := parseFit(value)
+			if err != nil {
+				invalidParams.add(param, InvalidParamCodeValue, err.Error())
+				break
+			}
+			*dest = fit
+
+		case *bimg.Gravity:
+			dest := dest.(*bimg.Gravity)
+			gravity, exists := gravities[value]
+			if !exists {
+				invalidParams.add(param, InvalidParamCodeValue, fmt.Sprintf("possible values for '%s' are centre, north, east, south, west, smart", param))
+				break
+			}
+			*dest = gravity
 		}
 	}
+
+	if form.Has("pos") && !form.Has("gr") {
+		options.Gravity = position
+	}
+
+	for param, focal := range map[string]float64{"fpx": options.FocalX, "fpy": options.FocalY} {
+		if focal < 0 || focal > 1 {
+			invalidParams.add(param, InvalidParamCodeRange, fmt.Sprintf("possible values for '%s' are between 0 and 1", param))
+		}
+	}
+	options.FocalPoint = form.Has("fpx") && form.Has("fpy")
+
+	for param, components := range map[string]int{"bhx": options.BlurHashX, "bhy": options.BlurHashY} {
+		if form.Has(param) && (components < 1 || components > 9) {
+			invalidParams.add(param, InvalidParamCodeRange, fmt.Sprintf("possible values for '%s' are between 1 and 9", param))
+		}
+	}
+
+	if form.Has("dpr") && dpr <= 0 {
+		invalidParams.add("dpr", InvalidParamCodeRange, "'dpr' must be greater than 0")
+	}
+
+	if len(invalidParams.Params) > 0 {
+		return options, invalidParams
+	}
+
+	if form.Has("dpr") {
+		options.Width = applyDevicePixelRatio(options.Width, dpr)
+		options.Height = applyDevicePixelRatio(options.Height, dpr)
+	}
+
+	options.applyFit()
 	return options, nil
 }
+
+// parseOptions parses the form like getOptions, and also checks parameters against the configuration
+func (m *Middleware) parseOptions(form *url.Values) (imageOptions, error) {
+	options, err := getOptions(form)
+
+	if name := form.Get("wmt"); name != "" && !m.TextWatermark.hasText(name) {
+		invalidParams := &InvalidParamsError{}
+		if err != nil && !errors.As(err, &invalidParams) {
+			return options, err
+		}
+		invalidParams.add("wmt", InvalidParamCodeValue, fmt.Sprintf("text watermark '%s' is not defined", name))
+		return options, invalidParams
+	}
+	return options, err
+}
+
+// parseColor parses a named color or a #xxxxxx hex string
+func parseColor(value string) (bimg.Color, error) {
+	switch value {
+	case "white":
+		return bimg.Color{255, 255, 255}, nil
+	case "black":
+		return bimg.Color{0, 0, 0}, nil
+	case "red":
+		return bimg.Color{255, 0, 0}, nil
+	case "magenta":
+		return bimg.Color{255, 0, 255}, nil
+	case "blue":
+		return bimg.Color{0, 0, 255}, nil
+	case "cyan":
+		return bimg.Color{0, 255, 255}, nil
+	case "green":
+		return bimg.Color{0, 255, 0}, nil
+	case "yellow":
+		return bimg.Color{255, 255, 0}, nil
+	}
+
+	c := bimg.Color{}
+	_, err := fmt.Sscanf(value, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	return c, err
+}
+
+// process runs libvips until the context is done. libvips jobs cannot be interrupted,
+// so a cancelled job keeps its processing slot until it actually finishes.
+func (m *Middleware) process(ctx context.Context, decoded []byte, options imageOptions) (string, []byte, error) {
+	if m.limiter != nil {
+		if err := m.limiter.acquire(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+
+	type result struct {
+		contentType string
+		body        []byte
+		err         error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if m.limiter != nil {
+			defer m.limiter.release()
+		}
+		contentType, body, err := m.render(decoded, options)
+		done <- result{contentType, body, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.contentType, res.body, res.err
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+// render returns the response body requested by the options with its content type
+func (m *Middleware) render(decoded []byte, options imageOptions) (string, []byte, error) {
+	if options.Info {
+		info, err := getImageInfo(decoded)
+		return "application/json", info, err
+	}
+
+	if options.Placeholder != "" {
+		return m.renderPlaceholder(decoded, options)
+	}
+
+	newImage, err := m.transform(decoded, options)
+	if err != nil {
+		return "", nil, err
+	}
+	return "image/" + bimg.DetermineImageTypeName(newImage), newImage, nil
+}
+
+// transform resolves options depending on the image itself and runs libvips
+func (m *Middleware) transform(decoded []byte, options imageOptions) ([]byte, error) {
+	start := time.Now()
+
+	if err := m.checkInputPixels(decoded); err != nil {
+		return nil, err
+	}
+
+	if options.needsSize() || options.usesFocalPoint() || m.MaxOutputPixels > 0 {
+		metadata, err := bimg.Metadata(decoded)
+		if err != nil {
+			return nil, err
+		}
+		options.resolveFit(metadata)
+		options.resolveFocalPoint(metadata)
+
+		// Reject sizes estimated from the source before processing, the actual size is checked afterward
+		if err := m.checkEstimatedOutputPixels(options, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	// Placeholders are never watermarked, they are too small for it
+	if options.Placeholder == "" {
+		textWatermark, err := m.TextWatermark.getWatermark(options.WatermarkText)
+		if err != nil {
+			return nil, err
+		}
+		options.Watermark = textWatermark
+	}
+
+	var newImage []byte
+	var err error
+	if m.Watermark != nil && m.Watermark.appliesTo(options) && options.Placeholder == "" {
+		newImage, err = m.Watermark.process(decoded, options.Options)
+	} else {
+		newImage, err = bimg.NewImage(decoded).Process(options.Options)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.MaxOutputPixels > 0 {
+		size, err := bimg.Size(newImage)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.checkOutputPixels(size.Width, size.Height); err != nil {
+			return nil, err
+		}
+	}
+
+	observeProcessing(start, decoded, newImage)
+	return newImage, nil
+}
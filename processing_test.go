@@ -0,0 +1,63 @@
+package CADDY_FILE_SERVER
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestGetOptions(t *testing.T) {
+	form, _ := url.ParseQuery("w=400")
+	options, err := getOptions(&form)
+	if err != nil {
+		t.Fatalf("getOptions(w=400) returned an error: %v", err)
+	}
+	if options.Width != 400 {
+		t.Errorf("Width = %d, want 400", options.Width)
+	}
+	if options.BlurHashX != 4 || options.BlurHashY != 3 {
+		t.Errorf("BlurHash components = %dx%d, want 4x3", options.BlurHashX, options.BlurHashY)
+	}
+}
+
+func TestGetOptionsInvalidParams(t *testing.T) {
+	form, _ := url.ParseQuery("w=abc&bhx=12&bhy=2")
+	_, err := getOptions(&form)
+
+	var invalidParams *InvalidParamsError
+	if !errors.As(err, &invalidParams) {
+		t.Fatalf("getOptions returned %v, want an InvalidParamsError", err)
+	}
+	if len(invalidParams.Params) != 2 {
+		t.Fatalf("got %d invalid params, want 2: %v", len(invalidParams.Params), invalidParams.Params)
+	}
+	if param := invalidParams.Params[0]; param.Param != "bhx" || param.Code != InvalidParamCodeRange {
+		t.Errorf("first invalid param = %+v, want bhx out of range", param)
+	}
+	if param := invalidParams.Params[1]; param.Param != "w" || param.Code != InvalidParamCodeInteger {
+		t.Errorf("second invalid param = %+v, want w not an integer", param)
+	}
+}
+
+func TestParseOptionsUnknownWatermarkText(t *testing.T) {
+	m := &Middleware{TextWatermark: &TextWatermarkOptions{Texts: map[string]string{"copyright": "© Example"}}}
+
+	form, _ := url.ParseQuery("w=400&wmt=copyright")
+	if _, err := m.parseOptions(&form); err != nil {
+		t.Fatalf("parseOptions(wmt=copyright) returned an error: %v", err)
+	}
+
+	form, _ = url.ParseQuery("w=abc&wmt=unknown")
+	_, err := m.parseOptions(&form)
+
+	var invalidParams *InvalidParamsError
+	if !errors.As(err, &invalidParams) {
+		t.Fatalf("parseOptions returned %v, want an InvalidParamsError", err)
+	}
+	if len(invalidParams.Params) != 2 || invalidParams.Params[0].Param != "w" || invalidParams.Params[1].Param != "wmt" {
+		t.Fatalf("got invalid params %+v, want w then wmt", invalidParams.Params)
+	}
+	if code := invalidParams.Params[1].Code; code != InvalidParamCodeValue {
+		t.Errorf("wmt code = %s, want %s", code, InvalidParamCodeValue)
+	}
+}
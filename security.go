@@ -2,6 +2,7 @@ package CADDY_FILE_SERVER
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -23,10 +24,85 @@ const (
 )
 
 type SecurityOptions struct {
-	OnSecurityFail   OnSecurityFail `json:"on_security_fail,omitempty"`
-	AllowedParams    *[]string      `json:"allowed_params,omitempty"`
-	DisallowedParams *[]string      `json:"disallowed_params,omitempty"`
-	Constraints      *Constraints   `json:"constraints,omitempty"`
+	OnSecurityFail   OnSecurityFail  `json:"on_security_fail,omitempty"`
+	AllowedParams    *[]string       `json:"allowed_params,omitempty"`
+	DisallowedParams *[]string       `json:"disallowed_params,omitempty"`
+	Constraints      *Constraints    `json:"constraints,omitempty"`
+	Signing          *SigningOptions `json:"signing,omitempty"`
+	OnlyPresets      bool            `json:"only_presets,omitempty"`
+}
+
+// ProcessRequestSignature
+// Ensures that the request is signed when signing is enabled.
+// Must be called on the raw form, signature parameters are removed once verified.
+func (s *SecurityOptions) ProcessRequestSignature(path string, form *url.Values) error {
+	// Unrelated query parameters, like cache busters, do not need to be signed
+	if s.Signing == nil || !hasProcessingParams(*form) {
+		return nil
+	}
+
+	if err := s.Signing.Verify(path, *form); err != nil {
+		// Expired urls are always rejected, whatever the security mode is
+		if errors.Is(err, ExpiredSignatureError) {
+			return &AbortRequestError{
+				Msg:    "signed url has expired",
+				Status: s.Signing.ExpiredStatus,
+			}
+		}
+
+		if s.OnSecurityFail == OnSecurityFailIgnore {
+			// No parameter can be trusted
+			for param := range *form {
+				form.Del(param)
+			}
+			return nil
+		} else if s.OnSecurityFail == OnSecurityFailBypass {
+			return BypassRequestError
+		} else if s.OnSecurityFail == OnSecurityFailAbort {
+			return &AbortRequestError{
+				Msg: fmt.Sprintf("signature verification failed: %s", err),
+			}
+		}
+		return err
+	}
+
+	form.Del(signatureParam)
+	form.Del(keyIDParam)
+	form.Del(expiresParam)
+	return nil
+}
+
+// ProcessRawParams
+// Ensures that no processing parameter is provided outside of presets when 'only_presets' is enabled.
+func (s *SecurityOptions) ProcessRawParams(form *url.Values) error {
+	for param := range *form {
+		if !slices.Contains(availableParams, param) {
+			continue
+		}
+		if s.OnSecurityFail == OnSecurityFailIgnore {
+			form.Del(param)
+		} else if s.OnSecurityFail == OnSecurityFailBypass {
+			return BypassRequestError
+		} else if s.OnSecurityFail == OnSecurityFailAbort {
+			return &AbortRequestError{
+				Msg:   fmt.Sprintf("parameter '%s' is only allowed through presets", param),
+				Param: param,
+			}
+		}
+	}
+	return nil
+}
+
+// fail returns the error matching OnSecurityFail for a failed security check that has nothing to remove
+func (s *SecurityOptions) fail(msg string) error {
+	if s.OnSecurityFail == OnSecurityFailBypass {
+		return BypassRequestError
+	} else if s.OnSecurityFail == OnSecurityFailAbort {
+		return &AbortRequestError{
+			Msg: msg,
+		}
+	}
+	return nil
 }
 
 // ProcessRequestForm
@@ -44,7 +120,8 @@ func (s *SecurityOptions) ProcessRequestForm(form *url.Values) error {
 					return BypassRequestError
 				} else if s.OnSecurityFail == OnSecurityFailAbort {
 					return &AbortRequestError{
-						fmt.Sprintf("parameter '%s' is not allowed", param),
+						Msg:   fmt.Sprintf("parameter '%s' is not allowed", param),
+						Param: param,
 					}
 				}
 			}
@@ -61,7 +138,8 @@ func (s *SecurityOptions) ProcessRequestForm(form *url.Values) error {
 					return BypassRequestError
 				} else if s.OnSecurityFail == OnSecurityFailAbort {
 					return &AbortRequestError{
-						fmt.Sprintf("parameter '%s' has been flagged as disallowed", param),
+						Msg:   fmt.Sprintf("parameter '%s' has been flagged as disallowed", param),
+						Param: param,
 					}
 				}
 			}
@@ -80,6 +158,11 @@ func (s *SecurityOptions) ProcessRequestForm(form *url.Values) error {
 // Provision Set default values if not defined
 func (s *SecurityOptions) Provision(ctx caddy.Context) error {
 	s.OnSecurityFail = cmp.Or(s.OnSecurityFail, OnSecurityFailIgnore)
+	if s.Signing != nil {
+		if err := s.Signing.Provision(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -99,16 +182,24 @@ func (s *SecurityOptions) Validate() error {
 		}
 	}
 
+	// Validate signing if exists
+	if s.Signing != nil {
+		if err := s.Signing.Validate(); err != nil {
+			return err
+		}
+	}
+
 	// Check that AllowedParams and DisallowedParams are not both specified
 	if s.AllowedParams != nil && s.DisallowedParams != nil {
 		return fmt.Errorf("'allowed_params' and 'disallowed_params' cannot be specified together")
 	}
 
-	// Ensure that at least one of AllowedParams or DisallowedParams or 'Constraints' is specified
+	// Ensure that at least one of AllowedParams or DisallowedParams or 'Constraints' or 'Signing' is specified
 	if (s.AllowedParams == nil || len(*s.AllowedParams) == 0) &&
 		(s.DisallowedParams == nil || len(*s.DisallowedParams) == 0) &&
-		(s.Constraints == nil || len(*s.Constraints) == 0) {
-		return fmt.Errorf("either 'allowed_params', 'disallowed_params', or 'constraints' must be specified")
+		(s.Constraints == nil || len(*s.Constraints) == 0) &&
+		s.Signing == nil && !s.OnlyPresets {
+		return fmt.Errorf("either 'allowed_params', 'disallowed_params', 'constraints', 'signing', or 'only_presets' must be specified")
 	}
 
 	// Validate that all elements in AllowedParams are in availableParams
@@ -176,6 +267,20 @@ func (s *SecurityOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 			break
+		case "signing":
+			s.Signing = &SigningOptions{}
+			if err := s.Signing.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			break
+		case "only_presets":
+			s.OnlyPresets = true
+
+			// Ensure there are no arguments
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			break
 		default:
 			return d.Errf("unexpected directive '%s' in security block", d.Val())
 		}
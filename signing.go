@@ -0,0 +1,178 @@
+package CADDY_FILE_SERVER
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// signatureParam holds the url signature
+	signatureParam = "s"
+
+	// keyIDParam optionally selects the key used to verify the signature
+	keyIDParam = "kid"
+
+	// expiresParam optionally holds the unix timestamp after which the signature is rejected
+	expiresParam = "exp"
+)
+
+// signedParams are parameters covered by the signature in addition to availableParams
+var signedParams = []string{keyIDParam, expiresParam, presetParam}
+
+// SigningOptions configure HMAC-SHA256 signed urls.
+// Keys maps key ids to secrets, several keys can be active at once to allow rotation.
+// ExpiredStatus is the status code returned for expired urls (403 or 410).
+type SigningOptions struct {
+	Keys          map[string]string `json:"keys,omitempty"`
+	ExpiredStatus int               `json:"expired_status,omitempty"`
+}
+
+// Provision replaces placeholders (like {env.IMAGE_SIGNING_KEY}) in secrets and set default values
+func (s *SigningOptions) Provision(ctx caddy.Context) error {
+	s.ExpiredStatus = cmp.Or(s.ExpiredStatus, http.StatusForbidden)
+
+	repl := caddy.NewReplacer()
+	for keyID, secret := range s.Keys {
+		s.Keys[keyID] = repl.ReplaceAll(secret, "")
+	}
+	return nil
+}
+
+// Validate ensure signing keys are correctly defined
+func (s *SigningOptions) Validate() error {
+	if len(s.Keys) == 0 {
+		return errors.New("'signing' requires at least one key")
+	}
+	for keyID, secret := range s.Keys {
+		if keyID == "" {
+			return errors.New("signing key id cannot be empty")
+		}
+		if secret == "" {
+			return fmt.Errorf("signing key '%s' has an empty secret", keyID)
+		}
+	}
+
+	switch s.ExpiredStatus {
+	case http.StatusForbidden, http.StatusGone:
+		// Valid values
+	default:
+		return fmt.Errorf("invalid value for 'expired_status': %d (expected 403 or 410)", s.ExpiredStatus)
+	}
+	return nil
+}
+
+// Sign returns the signature of the path and parameters using the given key
+func (s *SigningOptions) Sign(keyID string, path string, form url.Values) (string, error) {
+	secret, exists := s.Keys[keyID]
+	if !exists {
+		return "", fmt.Errorf("unknown signing key '%s'", keyID)
+	}
+	return computeSignature(secret, path, form), nil
+}
+
+// Verify ensures the 's' parameter is a valid signature of the path and parameters.
+// When 'kid' is provided only this key is tried, otherwise every key is.
+// Returns ExpiredSignatureError if the signature is valid but 'exp' is in the past.
+func (s *SigningOptions) Verify(path string, form url.Values) error {
+	signature := form.Get(signatureParam)
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+
+	var secrets []string
+	if keyID := form.Get(keyIDParam); keyID != "" {
+		secret, exists := s.Keys[keyID]
+		if !exists {
+			return fmt.Errorf("unknown signing key '%s'", keyID)
+		}
+		secrets = append(secrets, secret)
+	} else {
+		for _, secret := range s.Keys {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signature), []byte(computeSignature(secret, path, form))) {
+			return verifyExpiration(form)
+		}
+	}
+	return InvalidSignatureError
+}
+
+// verifyExpiration checks the optional 'exp' parameter against the current time
+func verifyExpiration(form url.Values) error {
+	if !form.Has(expiresParam) {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(form.Get(expiresParam), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiration timestamp: %s", form.Get(expiresParam))
+	}
+
+	if time.Now().Unix() > expires {
+		return ExpiredSignatureError
+	}
+	return nil
+}
+
+// getSignaturePayload returns the canonical representation of a request covered by the signature:
+// the path followed by the sorted processing parameters.
+func getSignaturePayload(path string, form url.Values) string {
+	signedForm := url.Values{}
+	for param, values := range form {
+		if slices.Contains(availableParams, param) || slices.Contains(signedParams, param) {
+			signedForm[param] = values
+		}
+	}
+	return path + "?" + signedForm.Encode()
+}
+
+func computeSignature(secret string, path string, form url.Values) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(getSignaturePayload(path, form)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *SigningOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	s.Keys = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "key":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.Err("key requires a key id and a secret")
+			}
+			if _, exists := s.Keys[args[0]]; exists {
+				return d.Errf("duplicate signing key '%s'", args[0])
+			}
+			s.Keys[args[0]] = args[1]
+		case "expired_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var err error
+			if s.ExpiredStatus, err = strconv.Atoi(d.Val()); err != nil {
+				return d.Errf("invalid value for expired_status: %v", err)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unexpected directive '%s' in signing block", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package CADDY_FILE_SERVER
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signForm(t *testing.T, signing *SigningOptions, keyID string, path string, form url.Values) url.Values {
+	t.Helper()
+	signature, err := signing.Sign(keyID, path, form)
+	if err != nil {
+		t.Fatalf("Sign(%s) returned an error: %v", keyID, err)
+	}
+	form.Set(signatureParam, signature)
+	return form
+}
+
+func TestVerify(t *testing.T) {
+	signing := &SigningOptions{Keys: map[string]string{"k1": "previous-secret", "k2": "secret"}}
+
+	tests := []struct {
+		name    string
+		form    func() url.Values
+		wantErr bool
+	}{
+		{
+			name: "valid signature",
+			form: func() url.Values {
+				return signForm(t, signing, "k2", "/image.jpg", url.Values{"w": {"400"}, keyIDParam: {"k2"}})
+			},
+		},
+		{
+			name: "wrong signature",
+			form: func() url.Values {
+				form := signForm(t, signing, "k2", "/image.jpg", url.Values{"w": {"400"}, keyIDParam: {"k2"}})
+				form.Set("w", "4000")
+				return form
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown key id",
+			form: func() url.Values {
+				form := signForm(t, signing, "k2", "/image.jpg", url.Values{"w": {"400"}})
+				form.Set(keyIDParam, "k3")
+				return form
+			},
+			wantErr: true,
+		},
+		{
+			name: "key rotation without key id",
+			form: func() url.Values {
+				return signForm(t, signing, "k1", "/image.jpg", url.Values{"w": {"400"}})
+			},
+		},
+		{
+			name: "unsigned extra parameter is ignored",
+			form: func() url.Values {
+				form := signForm(t, signing, "k2", "/image.jpg", url.Values{"w": {"400"}})
+				form.Set("v", "2")
+				return form
+			},
+		},
+		{
+			name:    "missing signature",
+			form:    func() url.Values { return url.Values{"w": {"400"}} },
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := signing.Verify("/image.jpg", test.form())
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: Verify() returned %v, want error: %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestProcessRequestSignatureExpired(t *testing.T) {
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	for _, status := range []int{http.StatusForbidden, http.StatusGone} {
+		for _, mode := range []OnSecurityFail{OnSecurityFailIgnore, OnSecurityFailBypass, OnSecurityFailAbort} {
+			signing := &SigningOptions{Keys: map[string]string{"k1": "secret"}, ExpiredStatus: status}
+			security := &SecurityOptions{OnSecurityFail: mode, Signing: signing}
+			form := signForm(t, signing, "k1", "/image.jpg", url.Values{"w": {"400"}, expiresParam: {expired}})
+
+			err := security.ProcessRequestSignature("/image.jpg", &form)
+
+			var abortRequestError *AbortRequestError
+			if !errors.As(err, &abortRequestError) || abortRequestError.Status != status {
+				t.Errorf("%s with expired_status %d: got %v, want an abort with status %d", mode, status, err, status)
+			}
+		}
+	}
+}
+
+func TestProcessRequestSignature(t *testing.T) {
+	signing := &SigningOptions{Keys: map[string]string{"k1": "secret"}}
+
+	// Signature parameters are removed once verified
+	form := signForm(t, signing, "k1", "/image.jpg", url.Values{"w": {"400"}, keyIDParam: {"k1"}})
+	security := &SecurityOptions{OnSecurityFail: OnSecurityFailAbort, Signing: signing}
+	if err := security.ProcessRequestSignature("/image.jpg", &form); err != nil {
+		t.Fatalf("valid signature: got %v", err)
+	}
+	if form.Has(signatureParam) || form.Has(keyIDParam) || form.Get("w") != "400" {
+		t.Errorf("valid signature: got form %v, want only w=400", form)
+	}
+
+	// Urls without processing parameters do not need a signature
+	form = url.Values{"v": {"2"}}
+	if err := security.ProcessRequestSignature("/image.jpg", &form); err != nil {
+		t.Errorf("cache buster: got %v, want no error", err)
+	}
+
+	// Invalid signatures are handled with on_security_fail
+	tests := []struct {
+		mode     OnSecurityFail
+		wantForm bool
+		check    func(err error) bool
+	}{
+		{OnSecurityFailIgnore, false, func(err error) bool { return err == nil }},
+		{OnSecurityFailBypass, true, func(err error) bool { return errors.Is(err, BypassRequestError) }},
+		{OnSecurityFailAbort, true, func(err error) bool {
+			var abortRequestError *AbortRequestError
+			return errors.As(err, &abortRequestError)
+		}},
+	}
+	for _, test := range tests {
+		security := &SecurityOptions{OnSecurityFail: test.mode, Signing: signing}
+		form := url.Values{"w": {"400"}, signatureParam: {"invalid"}}
+
+		err := security.ProcessRequestSignature("/image.jpg", &form)
+		if !test.check(err) {
+			t.Errorf("%s: unexpected error %v", test.mode, err)
+		}
+		if (len(form) > 0) != test.wantForm {
+			t.Errorf("%s: got form %v", test.mode, form)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package CADDY_FILE_SERVER
+
+import "expvar"
+
+// stats exposes processing counters on the expvar endpoint of the Caddy admin API (/debug/vars)
+var stats = expvar.NewMap("image_processor")
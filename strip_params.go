@@ -0,0 +1,27 @@
+package CADDY_FILE_SERVER
+
+import (
+	"net/http"
+	"slices"
+)
+
+// getUpstreamRequest returns a copy of the request without processing, signature and preset parameters,
+// so the upstream sees a single url per image. The original request keeps them for processing.
+func getUpstreamRequest(r *http.Request) *http.Request {
+	query := r.URL.Query()
+	stripped := false
+	for param := range query {
+		if param == signatureParam || slices.Contains(availableParams, param) || slices.Contains(signedParams, param) {
+			query.Del(param)
+			stripped = true
+		}
+	}
+	if !stripped {
+		return r
+	}
+
+	upstreamRequest := r.Clone(r.Context())
+	upstreamRequest.URL.RawQuery = query.Encode()
+	upstreamRequest.RequestURI = upstreamRequest.URL.RequestURI()
+	return upstreamRequest
+}
@@ -0,0 +1,161 @@
+package CADDY_FILE_SERVER
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/h2non/bimg"
+	"strconv"
+)
+
+// TextWatermarkOptions configure texts drawn on processed images.
+// Texts maps names to texts, selected with the 'wmt' parameter so clients never choose what is drawn.
+// Default is the name of the text drawn when 'wmt' is not provided (none if empty).
+type TextWatermarkOptions struct {
+	Texts     map[string]string `json:"texts,omitempty"`
+	Default   string            `json:"default,omitempty"`
+	Font      string            `json:"font,omitempty"`
+	DPI       int               `json:"dpi,omitempty"`
+	Opacity   float32           `json:"opacity,omitempty"`
+	Color     string            `json:"color,omitempty"`
+	Margin    int               `json:"margin,omitempty"`
+	Width     int               `json:"width,omitempty"`
+	Replicate bool              `json:"replicate,omitempty"`
+
+	color bimg.Color
+}
+
+// Provision set default values
+func (tw *TextWatermarkOptions) Provision(ctx caddy.Context) error {
+	tw.Color = cmp.Or(tw.Color, "white")
+
+	var err error
+	if tw.color, err = parseColor(tw.Color); err != nil {
+		return fmt.Errorf("invalid value for text watermark 'color': '%s' (expected white,black,red,magenta,blue,cyan,green,yellow or #xxxxxx hex string)", tw.Color)
+	}
+	return nil
+}
+
+// Validate ensure text watermark parameters are correctly defined
+func (tw *TextWatermarkOptions) Validate() error {
+	if len(tw.Texts) == 0 {
+		return fmt.Errorf("'text_watermark' requires at least one text")
+	}
+	for name, text := range tw.Texts {
+		if text == "" {
+			return fmt.Errorf("text watermark '%s' is empty", name)
+		}
+	}
+	if _, exists := tw.Texts[tw.Default]; tw.Default != "" && !exists {
+		return fmt.Errorf("default text watermark '%s' is not defined", tw.Default)
+	}
+	if tw.DPI < 0 || tw.Margin < 0 || tw.Width < 0 {
+		return fmt.Errorf("text watermark 'dpi', 'margin' and 'width' must be positive")
+	}
+	if tw.Opacity < 0 || tw.Opacity > 1 {
+		return fmt.Errorf("text watermark 'opacity' must be between 0 and 1")
+	}
+	return nil
+}
+
+// hasText returns true if a text watermark is defined with this name
+func (tw *TextWatermarkOptions) hasText(name string) bool {
+	if tw == nil {
+		return false
+	}
+	_, exists := tw.Texts[name]
+	return exists
+}
+
+// getWatermark returns the bimg watermark for the text selected by 'wmt', or the default one.
+// Zero values are replaced by bimg defaults (font "sans 10", 150 dpi, 0.25 opacity, width of a sixth of the image).
+func (tw *TextWatermarkOptions) getWatermark(name string) (bimg.Watermark, error) {
+	if tw == nil {
+		if name != "" {
+			return bimg.Watermark{}, fmt.Errorf("text watermark '%s' is not defined", name)
+		}
+		return bimg.Watermark{}, nil
+	}
+
+	name = cmp.Or(name, tw.Default)
+	if name == "" {
+		return bimg.Watermark{}, nil
+	}
+
+	text, exists := tw.Texts[name]
+	if !exists {
+		return bimg.Watermark{}, fmt.Errorf("text watermark '%s' is not defined", name)
+	}
+
+	return bimg.Watermark{
+		Text:        text,
+		Font:        tw.Font,
+		DPI:         tw.DPI,
+		Opacity:     tw.Opacity,
+		Background:  tw.color,
+		Margin:      tw.Margin,
+		Width:       tw.Width,
+		NoReplicate: !tw.Replicate,
+	}, nil
+}
+
+func (tw *TextWatermarkOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	tw.Texts = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+
+		switch option {
+		case "text":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.Err("text requires a name and a text")
+			}
+			if _, exists := tw.Texts[args[0]]; exists {
+				return d.Errf("duplicate text watermark '%s'", args[0])
+			}
+			tw.Texts[args[0]] = args[1]
+			continue
+		case "replicate":
+			tw.Replicate = true
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			continue
+		}
+
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		var err error
+		switch option {
+		case "default":
+			tw.Default = value
+		case "font":
+			tw.Font = value
+		case "color":
+			tw.Color = value
+		case "dpi":
+			tw.DPI, err = strconv.Atoi(value)
+		case "margin":
+			tw.Margin, err = strconv.Atoi(value)
+		case "width":
+			tw.Width, err = strconv.Atoi(value)
+		case "opacity":
+			var opacity float64
+			opacity, err = strconv.ParseFloat(value, 32)
+			tw.Opacity = float32(opacity)
+		default:
+			return d.Errf("unexpected directive '%s' in text_watermark block", option)
+		}
+		if err != nil {
+			return d.Errf("invalid value for %s: %v", option, err)
+		}
+	}
+	return nil
+}
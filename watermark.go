@@ -0,0 +1,259 @@
+package CADDY_FILE_SERVER
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/h2non/bimg"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// WatermarkMode represents the possible values for the watermark "mode" directive.
+type WatermarkMode string
+
+const (
+	// WatermarkModeAlways applies the watermark on every processed image.
+	WatermarkModeAlways WatermarkMode = "always"
+
+	// WatermarkModeParam applies the watermark only when the 'wm' parameter is true.
+	WatermarkModeParam WatermarkMode = "param"
+)
+
+// watermarkPositions lists valid positions, as horizontal and vertical alignment (0 start, 1 center, 2 end)
+var watermarkPositions = map[string][2]int{
+	"top-left":     {0, 0},
+	"top":          {1, 0},
+	"top-right":    {2, 0},
+	"left":         {0, 1},
+	"centre":       {1, 1},
+	"right":        {2, 1},
+	"bottom-left":  {0, 2},
+	"bottom":       {1, 2},
+	"bottom-right": {2, 2},
+}
+
+// maxScaledOverlays limits the number of resized overlays kept in memory
+const maxScaledOverlays = 64
+
+// WatermarkOptions configure an overlay image (PNG with alpha) composited on processed images.
+// Scale is the overlay width relative to the output width (0 keeps the overlay size).
+// Images smaller than MinSize (width or height) are not watermarked.
+type WatermarkOptions struct {
+	File     string        `json:"file,omitempty"`
+	Position string        `json:"position,omitempty"`
+	Margin   int           `json:"margin,omitempty"`
+	Opacity  float32       `json:"opacity,omitempty"`
+	Scale    float64       `json:"scale,omitempty"`
+	MinSize  int           `json:"min_size,omitempty"`
+	Mode     WatermarkMode `json:"mode,omitempty"`
+
+	overlay []byte
+
+	mu             sync.Mutex
+	scaledOverlays map[int][]byte
+}
+
+// Provision loads the overlay image and set default values
+func (wm *WatermarkOptions) Provision(ctx caddy.Context) error {
+	wm.Position = cmp.Or(wm.Position, "bottom-right")
+	wm.Opacity = cmp.Or(wm.Opacity, 1)
+	wm.Mode = cmp.Or(wm.Mode, WatermarkModeAlways)
+	wm.scaledOverlays = make(map[int][]byte)
+
+	if wm.File == "" {
+		return nil
+	}
+
+	var err error
+	if wm.overlay, err = os.ReadFile(wm.File); err != nil {
+		return fmt.Errorf("loading watermark file: %v", err)
+	}
+	return nil
+}
+
+// Validate ensure watermark parameters are correctly defined
+func (wm *WatermarkOptions) Validate() error {
+	if wm.File == "" {
+		return fmt.Errorf("watermark 'file' is required")
+	}
+	if bimg.DetermineImageType(wm.overlay) == bimg.UNKNOWN {
+		return fmt.Errorf("watermark file '%s' is not a supported image", wm.File)
+	}
+	if _, exists := watermarkPositions[wm.Position]; !exists {
+		return fmt.Errorf("invalid value for watermark 'position': '%s' (expected top-left, top, top-right, left, centre, right, bottom-left, bottom or bottom-right)", wm.Position)
+	}
+	if wm.Margin < 0 || wm.MinSize < 0 {
+		return fmt.Errorf("watermark 'margin' and 'min_size' must be positive")
+	}
+	if wm.Opacity <= 0 || wm.Opacity > 1 {
+		return fmt.Errorf("watermark 'opacity' must be between 0 and 1")
+	}
+	if wm.Scale < 0 || wm.Scale > 1 {
+		return fmt.Errorf("watermark 'scale' must be between 0 and 1")
+	}
+	switch wm.Mode {
+	case WatermarkModeAlways, WatermarkModeParam:
+		// Valid values
+	default:
+		return fmt.Errorf("invalid value for watermark 'mode': '%s' (expected 'always' or 'param')", wm.Mode)
+	}
+	return nil
+}
+
+// appliesTo returns true if the watermark must be composited for these options
+func (wm *WatermarkOptions) appliesTo(options imageOptions) bool {
+	return wm.Mode == WatermarkModeAlways || options.ApplyWatermark
+}
+
+// process transforms the image into a lossless intermediate first, so the overlay can be placed
+// once the output size is known, then composites it and encodes the requested format.
+func (wm *WatermarkOptions) process(decoded []byte, options bimg.Options) ([]byte, error) {
+	outputType := options.Type
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(decoded)
+	}
+
+	intermediateOptions := options
+	intermediateOptions.Type = bimg.PNG
+	intermediate, err := bimg.NewImage(decoded).Process(intermediateOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := bimg.Size(intermediate)
+	if err != nil {
+		return nil, err
+	}
+
+	finalOptions := bimg.Options{
+		Type:          outputType,
+		Quality:       options.Quality,
+		Compression:   options.Compression,
+		Lossless:      options.Lossless,
+		Interlace:     options.Interlace,
+		StripMetadata: options.StripMetadata,
+		Palette:       options.Palette,
+		Speed:         options.Speed,
+		NoAutoRotate:  true,
+	}
+	watermark, ok, err := wm.getWatermarkImage(size)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		finalOptions.WatermarkImage = watermark
+	}
+	return bimg.NewImage(intermediate).Process(finalOptions)
+}
+
+// getWatermarkImage returns the overlay placed on an image of the given size,
+// ok is false if the image is too small to be watermarked.
+func (wm *WatermarkOptions) getWatermarkImage(size bimg.ImageSize) (bimg.WatermarkImage, bool, error) {
+	if wm.MinSize > 0 && (size.Width < wm.MinSize || size.Height < wm.MinSize) {
+		return bimg.WatermarkImage{}, false, nil
+	}
+
+	overlay, err := wm.getOverlay(size.Width)
+	if err != nil {
+		return bimg.WatermarkImage{}, false, err
+	}
+	overlaySize, err := bimg.Size(overlay)
+	if err != nil {
+		return bimg.WatermarkImage{}, false, err
+	}
+
+	// Skip if the overlay does not fit in the image
+	if overlaySize.Width+2*wm.Margin > size.Width || overlaySize.Height+2*wm.Margin > size.Height {
+		return bimg.WatermarkImage{}, false, nil
+	}
+
+	alignment := watermarkPositions[wm.Position]
+	return bimg.WatermarkImage{
+		Left:    alignWatermark(alignment[0], size.Width, overlaySize.Width, wm.Margin),
+		Top:     alignWatermark(alignment[1], size.Height, overlaySize.Height, wm.Margin),
+		Buf:     overlay,
+		Opacity: wm.Opacity,
+	}, true, nil
+}
+
+// getOverlay returns the overlay resized relatively to the image width
+func (wm *WatermarkOptions) getOverlay(width int) ([]byte, error) {
+	if wm.Scale == 0 {
+		return wm.overlay, nil
+	}
+	overlayWidth := max(1, int(math.Round(float64(width)*wm.Scale)))
+
+	wm.mu.Lock()
+	overlay, exists := wm.scaledOverlays[overlayWidth]
+	wm.mu.Unlock()
+	if exists {
+		return overlay, nil
+	}
+
+	overlay, err := bimg.Resize(wm.overlay, bimg.Options{Width: overlayWidth, Enlarge: true, Type: bimg.PNG})
+	if err != nil {
+		return nil, err
+	}
+
+	wm.mu.Lock()
+	if len(wm.scaledOverlays) >= maxScaledOverlays {
+		clear(wm.scaledOverlays)
+	}
+	wm.scaledOverlays[overlayWidth] = overlay
+	wm.mu.Unlock()
+	return overlay, nil
+}
+
+func alignWatermark(alignment int, size int, overlaySize int, margin int) int {
+	switch alignment {
+	case 0:
+		return margin
+	case 1:
+		return (size - overlaySize) / 2
+	default:
+		return size - overlaySize - margin
+	}
+}
+
+func (wm *WatermarkOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		value := d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		var err error
+		switch option {
+		case "file":
+			wm.File = value
+		case "position":
+			wm.Position = value
+		case "mode":
+			wm.Mode = WatermarkMode(value)
+		case "margin":
+			wm.Margin, err = strconv.Atoi(value)
+		case "min_size":
+			wm.MinSize, err = strconv.Atoi(value)
+		case "scale":
+			wm.Scale, err = strconv.ParseFloat(value, 64)
+		case "opacity":
+			var opacity float64
+			opacity, err = strconv.ParseFloat(value, 32)
+			wm.Opacity = float32(opacity)
+		default:
+			return d.Errf("unexpected directive '%s' in watermark block", option)
+		}
+		if err != nil {
+			return d.Errf("invalid value for %s: %v", option, err)
+		}
+	}
+	return nil
+}